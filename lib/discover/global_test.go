@@ -115,7 +115,7 @@ func TestGlobalOverHTTPS(t *testing.T) {
 
 	// Generate a server certificate, using fewer bits than usual to hurry the
 	// process along a bit.
-	cert, err := tlsutil.NewCertificate(dir+"/cert.pem", dir+"/key.pem", "syncthing", 1024)
+	cert, err := tlsutil.NewCertificate(dir+"/cert.pem", dir+"/key.pem", "syncthing", 2048)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -187,7 +187,7 @@ func TestGlobalAnnounce(t *testing.T) {
 
 	// Generate a server certificate, using fewer bits than usual to hurry the
 	// process along a bit.
-	cert, err := tlsutil.NewCertificate(dir+"/cert.pem", dir+"/key.pem", "syncthing", 1024)
+	cert, err := tlsutil.NewCertificate(dir+"/cert.pem", dir+"/key.pem", "syncthing", 2048)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,158 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+)
+
+// A CA is a certificate authority able to sign other certificates.
+type CA struct {
+	// Certificate is the CA certificate and key as a tls.Certificate.
+	Certificate tls.Certificate
+
+	// Cert is the parsed CA certificate and Signer its private key, as
+	// used to sign other certificates.
+	Cert   *x509.Certificate
+	Signer crypto.Signer
+}
+
+// NewCA generates a new self signed certificate authority with an RSA key
+// of the given size. A zero validity means the CA is valid until the end of
+// 2049.
+func NewCA(commonName string, validity time.Duration, rsaBits int) (*CA, error) {
+	return newCA(nil, commonName, validity, rsaBits)
+}
+
+// NewIntermediate generates a new intermediate certificate authority signed
+// by this CA. Its certificate chain includes the chain of this CA.
+func (ca *CA) NewIntermediate(commonName string, validity time.Duration, rsaBits int) (*CA, error) {
+	return newCA(ca, commonName, validity, rsaBits)
+}
+
+// newCA generates a certificate authority signed by the parent, or self
+// signed if parent is nil.
+func newCA(parent *CA, commonName string, validity time.Duration, rsaBits int) (*CA, error) {
+	priv, err := generateRSAKey(context.Background(), rsaBits, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	template, err := certificateTemplate(CertificateOptions{
+		CommonName: commonName,
+		Validity:   validity,
+		KeyUsage:   x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}, x509.SHA256WithRSA)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.ExtKeyUsage = nil
+	if template.SubjectKeyId, err = subjectKeyID(priv.Public()); err != nil {
+		return nil, err
+	}
+
+	signerCert, signer := template, crypto.Signer(priv)
+	var chain [][]byte
+	if parent != nil {
+		signerCert, signer = parent.Cert, parent.Signer
+		template.AuthorityKeyId = parent.Cert.SubjectKeyId
+		chain = parent.Certificate.Certificate
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, signerCert, priv.Public(), signer)
+	if err != nil {
+		return nil, fmt.Errorf("create cert: %s", err)
+	}
+
+	leaf, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse cert: %s", err)
+	}
+
+	return &CA{
+		Certificate: tls.Certificate{
+			Certificate: append([][]byte{derBytes}, chain...),
+			PrivateKey:  priv,
+			Leaf:        leaf,
+		},
+		Cert:   leaf,
+		Signer: priv,
+	}, nil
+}
+
+// SignCertificate generates a new certificate signed by the given CA. The
+// subject alternative names are added as IP addresses or DNS names as
+// appropriate. The certificate has a new ECDSA P-256 key. A zero validity
+// means the certificate is valid until the end of 2049. The returned
+// certificate chain contains the new certificate followed by the CA
+// certificate, so that it can be presented as is by a TLS server.
+func SignCertificate(caCert *x509.Certificate, caKey crypto.Signer, commonName string, sans []string, validity time.Duration) (tls.Certificate, error) {
+	opts := CertificateOptions{
+		CommonName: commonName,
+		Validity:   validity,
+	}
+	for _, san := range sans {
+		if ip := net.ParseIP(san); ip != nil {
+			opts.IPAddresses = append(opts.IPAddresses, ip)
+		} else {
+			opts.DNSNames = append(opts.DNSNames, san)
+		}
+	}
+
+	return SignCertificateWithOptions(caCert, caKey, opts)
+}
+
+// SignCertificateWithOptions is like SignCertificate, but with the
+// certificate properties given by opts, such as MustStaple or
+// OmitKeyIdentifiers. The key is always a new ECDSA P-256 key and nothing
+// is written to disk, so the options about the key and its files are not
+// used.
+func SignCertificateWithOptions(caCert *x509.Certificate, caKey crypto.Signer, opts CertificateOptions) (tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generate key: %s", err)
+	}
+
+	// The signature algorithm is left for x509 to choose based on the CA
+	// key type.
+	template, err := certificateTemplate(opts, x509.UnknownSignatureAlgorithm)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template.AuthorityKeyId = caCert.SubjectKeyId
+	if !opts.OmitKeyIdentifiers {
+		if template.SubjectKeyId, err = subjectKeyID(priv.Public()); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, caCert, priv.Public(), caKey)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("create cert: %s", err)
+	}
+
+	leaf, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("parse cert: %s", err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{derBytes, caCert.Raw},
+		PrivateKey:  priv,
+		Leaf:        leaf,
+	}, nil
+}
@@ -0,0 +1,194 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"testing"
+	"time"
+)
+
+func TestNewCA(t *testing.T) {
+	ca, err := NewCA("syncthing ca", 24*time.Hour, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ca.Cert.IsCA {
+		t.Error("CA certificate should have IsCA set")
+	}
+	if ca.Cert.KeyUsage&x509.KeyUsageCertSign == 0 || ca.Cert.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		t.Errorf("CA certificate lacks signing key usage: %v", ca.Cert.KeyUsage)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	if _, err := ca.Cert.Verify(x509.VerifyOptions{Roots: pool}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSignCertificate(t *testing.T) {
+	ca, err := NewCA("syncthing ca", 24*time.Hour, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := SignCertificate(ca.Cert, ca.Signer, "device", []string{"device.example.com", "192.0.2.42"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(cert.Leaf.AuthorityKeyId, ca.Cert.SubjectKeyId) {
+		t.Error("authority key ID does not match the CA subject key ID")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	for _, name := range []string{"device.example.com", "192.0.2.42"} {
+		_, err := cert.Leaf.Verify(x509.VerifyOptions{
+			Roots:     pool,
+			DNSName:   name,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+		if err != nil {
+			t.Errorf("verify %s: %v", name, err)
+		}
+	}
+
+	// A certificate from an unrelated CA should not verify.
+
+	other, err := NewCA("other ca", 24*time.Hour, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPool := x509.NewCertPool()
+	otherPool.AddCert(other.Cert)
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{Roots: otherPool}); err == nil {
+		t.Error("unexpected nil error verifying against unrelated CA")
+	}
+}
+
+func TestSignCertificateChain(t *testing.T) {
+	root, err := NewCA("syncthing root", 24*time.Hour, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediate, err := root.NewIntermediate("syncthing intermediate", 24*time.Hour, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := SignCertificate(intermediate.Cert, intermediate.Signer, "device", []string{"device.example.com"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.Certificate) != 2 || !bytes.Equal(cert.Certificate[1], intermediate.Cert.Raw) {
+		t.Fatal("certificate chain should be leaf and intermediate")
+	}
+
+	// A client trusting only the root must accept the leaf and
+	// intermediate presented by the server.
+
+	list, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Close()
+
+	go func() {
+		conn, err := list.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*tls.Conn).Handshake()
+		conn.Close()
+	}()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(root.Cert)
+	conn, err := tls.Dial("tcp", list.Addr().String(), &tls.Config{
+		RootCAs:    pool,
+		ServerName: "device.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestKeyIdentifiers(t *testing.T) {
+	ca, err := NewCA("syncthing ca", 24*time.Hour, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := SignCertificate(ca.Cert, ca.Signer, "device", nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	self, err := NewCertificateInMemory("syncthing", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cert := range []*x509.Certificate{ca.Cert, leaf.Leaf, self.Leaf} {
+		expected, err := subjectKeyID(cert.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cert.SubjectKeyId) == 0 || !bytes.Equal(cert.SubjectKeyId, expected) {
+			t.Errorf("%s: subject key ID %x, expected %x", cert.Subject.CommonName, cert.SubjectKeyId, expected)
+		}
+	}
+	if !bytes.Equal(leaf.Leaf.AuthorityKeyId, ca.Cert.SubjectKeyId) {
+		t.Errorf("authority key ID %x does not match the CA subject key ID %x", leaf.Leaf.AuthorityKeyId, ca.Cert.SubjectKeyId)
+	}
+
+	opts := CertificateOptions{CommonName: "device", OmitKeyIdentifiers: true}
+	leaf, err = SignCertificateWithOptions(ca.Cert, ca.Signer, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaf.Leaf.SubjectKeyId) != 0 {
+		t.Errorf("subject key ID %x present, should be omitted", leaf.Leaf.SubjectKeyId)
+	}
+}
+
+func TestMustStaple(t *testing.T) {
+	ca, err := NewCA("syncthing ca", 24*time.Hour, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mustStaple := range []bool{true, false} {
+		cert, err := SignCertificateWithOptions(ca.Cert, ca.Signer, CertificateOptions{CommonName: "device", MustStaple: mustStaple})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var found bool
+		for _, ext := range cert.Leaf.Extensions {
+			if !ext.Id.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}) {
+				continue
+			}
+			found = true
+			var features []int
+			if _, err := asn1.Unmarshal(ext.Value, &features); err != nil {
+				t.Fatal(err)
+			}
+			if len(features) != 1 || features[0] != 5 {
+				t.Errorf("TLS features %v, expected status_request (5)", features)
+			}
+		}
+		if found != mustStaple {
+			t.Errorf("must staple %v: TLS feature extension present %v", mustStaple, found)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// CertPoolFromDir returns a pool of the certificates in the .pem and .crt
+// files in dir, for use as RootCAs or ClientCAs. Files may hold several PEM
+// encoded certificates, or a single DER encoded one. Files that can't be
+// read or hold no certificate are skipped; other files are ignored.
+func CertPoolFromDir(dir string) (*x509.CertPool, error) {
+	return CertPoolFromDirWithLogger(dir, nil)
+}
+
+// CertPoolFromDirWithLogger is like CertPoolFromDir, but logs a warning to
+// logger, if not nil, for each file that is skipped.
+func CertPoolFromDirWithLogger(dir string, logger Logger) (*x509.CertPool, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	for _, info := range infos {
+		ext := strings.ToLower(filepath.Ext(info.Name()))
+		if info.IsDir() || (ext != ".pem" && ext != ".crt") {
+			continue
+		}
+
+		path := filepath.Join(dir, info.Name())
+		certs, err := loadCertificates(path)
+		if err != nil {
+			if logger != nil {
+				logger.Warnf("Skipping %s: %v", path, err)
+			}
+			continue
+		}
+		for _, cert := range certs {
+			pool.AddCert(cert)
+		}
+	}
+	return pool, nil
+}
+
+// loadCertificates returns the certificates in the file at path.
+func loadCertificates(path string) ([]*x509.Certificate, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(bs); block == nil {
+		// Not PEM at all.
+		cert, err := x509.ParseCertificate(bs)
+		if err != nil {
+			return nil, fmt.Errorf("parse certificate: %s", err)
+		}
+		return []*x509.Certificate{cert}, nil
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, bs = pem.Decode(bs)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse certificate: %s", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return certs, nil
+}
@@ -0,0 +1,88 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCertPoolFromDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Two PEM files, one of them also holding the key, and a DER file.
+	var certs []tls.Certificate
+	for _, name := range []string{"a.pem", "b.pem", "c.crt"} {
+		cert, err := NewCertificateInMemory(name, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, cert)
+
+		var bs []byte
+		switch name {
+		case "a.pem":
+			bs, err = CertificatePEM(cert)
+		case "b.pem":
+			bs, err = CertificatePEM(cert)
+			if err == nil {
+				var key []byte
+				key, err = PrivateKeyPEM(cert)
+				bs = append(key, bs...)
+			}
+		case "c.crt":
+			bs, err = CertificateDER(cert)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), bs, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "junk.pem"), []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "README"), []byte("ignored"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := &testLogger{}
+	pool, err := CertPoolFromDirWithLogger(dir, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quiet, err := CertPoolFromDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, cert := range certs {
+		if _, err := cert.Leaf.Verify(x509.VerifyOptions{Roots: pool}); err != nil {
+			t.Errorf("certificate %d not in pool: %v", i, err)
+		}
+		if _, err := cert.Leaf.Verify(x509.VerifyOptions{Roots: quiet}); err != nil {
+			t.Errorf("certificate %d not in pool without logger: %v", i, err)
+		}
+	}
+	if len(logger.msgs) != 1 || !strings.Contains(logger.msgs[0], "junk.pem") {
+		t.Errorf("expected a warning about junk.pem, got %q", logger.msgs)
+	}
+
+	if _, err := CertPoolFromDir(filepath.Join(dir, "missing")); err == nil {
+		t.Error("unexpected nil error for a missing directory")
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The range of TLS versions supported by SetVersions.
+const (
+	MinSupportedVersion = tls.VersionTLS12
+	MaxSupportedVersion = tls.VersionTLS13
+)
+
+// SetVersions restricts cfg to TLS versions min through max, which must be
+// within MinSupportedVersion and MaxSupportedVersion.
+func SetVersions(cfg *tls.Config, min, max uint16) error {
+	if min < MinSupportedVersion || max > MaxSupportedVersion {
+		return fmt.Errorf("TLS versions %s to %s outside of supported range", versionName(min), versionName(max))
+	}
+	if max < min {
+		return fmt.Errorf("TLS max version %s is lower than min version %s", versionName(max), versionName(min))
+	}
+	cfg.MinVersion = min
+	cfg.MaxVersion = max
+	return nil
+}
+
+func versionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	default:
+		return fmt.Sprintf("0x%04x", version)
+	}
+}
+
+// The TLS 1.2 cipher suites we consider safe: forward secret key exchange
+// and AEAD encryption only. TLS 1.3 suites all fulfil this and can't be
+// configured.
+var secureCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// SecureCipherSuites returns the TLS 1.2 cipher suites suitable for device
+// to device connections, in order of preference.
+func SecureCipherSuites() []uint16 {
+	return append([]uint16(nil), secureCipherSuites...)
+}
+
+// ValidateCipherSuites returns an error if any of the given cipher suites is
+// not one of SecureCipherSuites.
+func ValidateCipherSuites(suites []uint16) error {
+	for _, suite := range suites {
+		if !isSecureCipherSuite(suite) {
+			return fmt.Errorf("cipher suite %s is not allowed", tls.CipherSuiteName(suite))
+		}
+	}
+	return nil
+}
+
+func isSecureCipherSuite(suite uint16) bool {
+	for _, secure := range secureCipherSuites {
+		if suite == secure {
+			return true
+		}
+	}
+	return false
+}
+
+// SecureDefaultTLSConfig returns a TLS configuration using the given
+// certificate that accepts only TLS 1.2 and later with the cipher suites
+// from SecureCipherSuites. Use SetVersions on the result to require TLS 1.3.
+//
+// Syncthing never needs TLS 1.2 renegotiation, so it's refused: clients
+// using the configuration reject a server's request to renegotiate, and the
+// Go TLS server doesn't support renegotiation at all, answering a client's
+// attempt with an alert.
+func SecureDefaultTLSConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates:             []tls.Certificate{cert},
+		MinVersion:               MinSupportedVersion,
+		CipherSuites:             SecureCipherSuites(),
+		PreferServerCipherSuites: true,
+		// The default, but we don't want it to change under us.
+		Renegotiation: tls.RenegotiateNever,
+	}
+}
+
+// ConfigOptions are the options for SecureDefaultTLSConfigWithOptions.
+type ConfigOptions struct {
+	// DisableSessionTickets turns off session resumption using tickets,
+	// as WithoutSessionTickets does.
+	DisableSessionTickets bool
+
+	// SessionTicketRotation, if set, replaces the session ticket key at
+	// this interval using a SessionTicketRotator, until the context is
+	// cancelled. It can't be combined with DisableSessionTickets.
+	SessionTicketRotation time.Duration
+}
+
+// SecureDefaultTLSConfigWithOptions is like SecureDefaultTLSConfig, with
+// additional options. The context limits how long the session ticket key
+// is rotated, if that's enabled; the returned configuration stays usable
+// after that, with the last key.
+func SecureDefaultTLSConfigWithOptions(ctx context.Context, cert tls.Certificate, opts ConfigOptions) (*tls.Config, error) {
+	if opts.DisableSessionTickets && opts.SessionTicketRotation > 0 {
+		return nil, errors.New("session ticket rotation requested with session tickets disabled")
+	}
+
+	cfg := SecureDefaultTLSConfig(cert)
+	if opts.DisableSessionTickets {
+		WithoutSessionTickets(cfg)
+	}
+	if opts.SessionTicketRotation > 0 {
+		r, err := NewSessionTicketRotator(cfg)
+		if err != nil {
+			return nil, err
+		}
+		go r.Run(ctx, opts.SessionTicketRotation)
+	}
+	return cfg, nil
+}
+
+// WithALPN sets the application protocols offered or accepted by cfg, in
+// order of preference, and returns cfg.
+func WithALPN(cfg *tls.Config, protos ...string) *tls.Config {
+	cfg.NextProtos = append([]string(nil), protos...)
+	return cfg
+}
+
+// NegotiatedProtocol returns the application protocol agreed on during the
+// handshake, or the empty string if there was none. The handshake is
+// performed if it hasn't been already.
+func NegotiatedProtocol(conn *tls.Conn) string {
+	if err := conn.Handshake(); err != nil {
+		return ""
+	}
+	return conn.ConnectionState().NegotiatedProtocol
+}
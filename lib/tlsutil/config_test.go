@@ -0,0 +1,231 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+// handshakeConfigs performs a handshake between a server and a client with
+// the given configurations over a loopback connection, returning the client
+// side connection state. The error is from the client if it failed, or
+// otherwise from the server.
+func handshakeConfigs(serverCfg, clientCfg *tls.Config) (tls.ConnectionState, error) {
+	list, err := tls.Listen("tcp", "127.0.0.1:0", serverCfg)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer list.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := list.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+		errs <- conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := tls.Dial("tcp", list.Addr().String(), clientCfg)
+	if err != nil {
+		list.Close()
+		<-errs
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+
+	return conn.ConnectionState(), <-errs
+}
+
+func TestSecureDefaultTLSConfig(t *testing.T) {
+	cert := TestCertificate()
+	cfg := SecureDefaultTLSConfig(cert)
+	if cfg.Renegotiation != tls.RenegotiateNever {
+		t.Errorf("renegotiation setting %v, expected RenegotiateNever", cfg.Renegotiation)
+	}
+
+	cases := []struct {
+		version uint16
+		ok      bool
+	}{
+		{tls.VersionTLS10, false},
+		{tls.VersionTLS11, false},
+		{tls.VersionTLS12, true},
+		{tls.VersionTLS13, true},
+	}
+
+	for _, tc := range cases {
+		state, err := handshakeConfigs(cfg, &tls.Config{
+			InsecureSkipVerify: true,
+			MinVersion:         tls.VersionTLS10,
+			MaxVersion:         tc.version,
+		})
+		if tc.ok && err != nil {
+			t.Errorf("version %x: unexpected error %v", tc.version, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("version %x: handshake should have failed", tc.version)
+		}
+		if tc.ok && state.Version != tc.version {
+			t.Errorf("version %x: negotiated %x", tc.version, state.Version)
+		}
+	}
+}
+
+func TestValidateCipherSuites(t *testing.T) {
+	if err := ValidateCipherSuites(SecureCipherSuites()); err != nil {
+		t.Error(err)
+	}
+	if err := ValidateCipherSuites(nil); err != nil {
+		t.Error(err)
+	}
+
+	weak := []uint16{
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA,
+	}
+	for _, suite := range weak {
+		suites := append(SecureCipherSuites(), suite)
+		if err := ValidateCipherSuites(suites); err == nil {
+			t.Errorf("%s should not be allowed", tls.CipherSuiteName(suite))
+		}
+	}
+}
+
+func TestSecureCipherSuitesNegotiated(t *testing.T) {
+	cert := TestCertificate()
+	cfg := SecureDefaultTLSConfig(cert)
+
+	// A client offering weak suites first still gets an AEAD suite.
+	offered := []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	}
+	state, err := handshakeConfigs(cfg, &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		CipherSuites:       offered,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSecureCipherSuite(state.CipherSuite) {
+		t.Errorf("negotiated %s", tls.CipherSuiteName(state.CipherSuite))
+	}
+
+	// A client offering only weak suites fails.
+	_, err = handshakeConfigs(cfg, &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		CipherSuites:       offered[:3],
+	})
+	if err == nil {
+		t.Error("handshake with only weak cipher suites should fail")
+	}
+}
+
+func TestSetVersions(t *testing.T) {
+	cases := []struct {
+		min, max uint16
+		ok       bool
+	}{
+		{tls.VersionTLS12, tls.VersionTLS13, true},
+		{tls.VersionTLS12, tls.VersionTLS12, true},
+		{tls.VersionTLS13, tls.VersionTLS13, true},
+		{tls.VersionTLS13, tls.VersionTLS12, false},
+		{tls.VersionTLS10, tls.VersionTLS13, false},
+		{tls.VersionTLS11, tls.VersionTLS12, false},
+		{tls.VersionTLS12, 0x0305, false},
+	}
+
+	for _, tc := range cases {
+		cfg := &tls.Config{}
+		err := SetVersions(cfg, tc.min, tc.max)
+		if tc.ok && err != nil {
+			t.Errorf("%x-%x: unexpected error %v", tc.min, tc.max, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%x-%x: should fail", tc.min, tc.max)
+		}
+		if tc.ok && (cfg.MinVersion != tc.min || cfg.MaxVersion != tc.max) {
+			t.Errorf("%x-%x: set %x-%x", tc.min, tc.max, cfg.MinVersion, cfg.MaxVersion)
+		}
+		if !tc.ok && (cfg.MinVersion != 0 || cfg.MaxVersion != 0) {
+			t.Errorf("%x-%x: config modified despite error", tc.min, tc.max)
+		}
+	}
+}
+
+func TestTLS13OnlyRefusesTLS12(t *testing.T) {
+	cert := TestCertificate()
+	cfg := SecureDefaultTLSConfig(cert)
+	if err := SetVersions(cfg, tls.VersionTLS13, tls.VersionTLS13); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := handshakeConfigs(cfg, &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+	})
+	if err == nil || !strings.Contains(err.Error(), "protocol version not supported") {
+		t.Errorf("expected a protocol version error, got %v", err)
+	}
+
+	state, err := handshakeConfigs(cfg, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != tls.VersionTLS13 {
+		t.Errorf("negotiated version %x", state.Version)
+	}
+}
+
+func TestALPN(t *testing.T) {
+	cert := TestCertificate()
+	serverCfg := WithALPN(SecureDefaultTLSConfig(cert), "bep/1.0")
+	clientCfg := WithALPN(&tls.Config{InsecureSkipVerify: true}, "bep/2.0", "bep/1.0")
+
+	list, err := tls.Listen("tcp", "127.0.0.1:0", serverCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Close()
+
+	protos := make(chan string, 1)
+	go func() {
+		conn, err := list.Accept()
+		if err != nil {
+			protos <- ""
+			return
+		}
+		defer conn.Close()
+		protos <- NegotiatedProtocol(conn.(*tls.Conn))
+	}()
+
+	conn, err := tls.Dial("tcp", list.Addr().String(), clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if proto := NegotiatedProtocol(conn); proto != "bep/1.0" {
+		t.Errorf("client negotiated %q", proto)
+	}
+	if proto := <-protos; proto != "bep/1.0" {
+		t.Errorf("server negotiated %q", proto)
+	}
+}
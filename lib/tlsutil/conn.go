@@ -0,0 +1,235 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A CountingConn counts the bytes read from and written to the connection
+// it wraps. It's safe for concurrent use.
+type CountingConn struct {
+	net.Conn
+	in  atomic.Int64
+	out atomic.Int64
+}
+
+// NewCountingConn returns a CountingConn wrapping conn.
+func NewCountingConn(conn net.Conn) *CountingConn {
+	return &CountingConn{Conn: conn}
+}
+
+func (c *CountingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.in.Add(int64(n))
+	return n, err
+}
+
+func (c *CountingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.out.Add(int64(n))
+	return n, err
+}
+
+// BytesIn returns the number of bytes read so far.
+func (c *CountingConn) BytesIn() int64 {
+	return c.in.Load()
+}
+
+// BytesOut returns the number of bytes written so far.
+func (c *CountingConn) BytesOut() int64 {
+	return c.out.Load()
+}
+
+// Unwrap returns the wrapped connection.
+func (c *CountingConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// ConnectionCounter returns the CountingConn underlying a connection from
+// DowngradingListener with CountBytes set, looking through the TLS and
+// other wrapping layers.
+func ConnectionCounter(conn net.Conn) (*CountingConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *CountingConn:
+			return c, true
+		case *tls.Conn:
+			conn = c.NetConn()
+		case interface{ Unwrap() net.Conn }:
+			conn = c.Unwrap()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// ConnectionID returns the ID of the UnionedConnection underlying a
+// connection from DowngradingListener, looking through the TLS and other
+// wrapping layers.
+func ConnectionID(conn net.Conn) (uint64, bool) {
+	for {
+		switch c := conn.(type) {
+		case *UnionedConnection:
+			return c.ID(), true
+		case *tls.Conn:
+			conn = c.NetConn()
+		case interface{ Unwrap() net.Conn }:
+			conn = c.Unwrap()
+		default:
+			return 0, false
+		}
+	}
+}
+
+// baseConn returns the innermost connection below any layers with an
+// Unwrap method, like CountingConn.
+func baseConn(conn net.Conn) net.Conn {
+	for {
+		u, ok := conn.(interface{ Unwrap() net.Conn })
+		if !ok {
+			return conn
+		}
+		conn = u.Unwrap()
+	}
+}
+
+// ErrIdleTimeout is returned by IdleTimeoutConn when the connection was
+// closed for being idle.
+var ErrIdleTimeout = errors.New("connection closed after idle timeout")
+
+// An IdleTimeoutConn closes the connection it wraps when there has been no
+// successful Read or Write for the timeout. Reads and writes after that
+// return ErrIdleTimeout. It can wrap the connections returned by
+// DowngradingListener, TLS or not.
+type IdleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+
+	mut   sync.Mutex
+	timer *time.Timer
+	idle  bool
+}
+
+// NewIdleTimeoutConn returns an IdleTimeoutConn wrapping conn, closing it
+// after timeout without activity.
+func NewIdleTimeoutConn(conn net.Conn, timeout time.Duration) *IdleTimeoutConn {
+	c := &IdleTimeoutConn{Conn: conn, timeout: timeout}
+	c.timer = time.AfterFunc(timeout, c.expire)
+	return c
+}
+
+func (c *IdleTimeoutConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	return n, c.activity(n, err)
+}
+
+func (c *IdleTimeoutConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	return n, c.activity(n, err)
+}
+
+// Close closes the connection and stops the idle timer.
+func (c *IdleTimeoutConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
+
+// Unwrap returns the wrapped connection.
+func (c *IdleTimeoutConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// activity restarts the idle timer after a successful transfer, and
+// replaces the error for a connection already closed for being idle.
+func (c *IdleTimeoutConn) activity(n int, err error) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if c.idle {
+		return ErrIdleTimeout
+	}
+	if n > 0 {
+		c.timer.Reset(c.timeout)
+	}
+	return err
+}
+
+func (c *IdleTimeoutConn) expire() {
+	c.mut.Lock()
+	c.idle = true
+	c.mut.Unlock()
+	c.Conn.Close()
+}
+
+// ErrMaxLifetime is returned by MaxLifetimeConn when the connection was
+// closed for having been open for too long.
+var ErrMaxLifetime = errors.New("connection closed after maximum lifetime")
+
+// A MaxLifetimeConn closes the connection it wraps once it has been open for
+// the given lifetime, regardless of activity. Reads and writes after that
+// return ErrMaxLifetime.
+type MaxLifetimeConn struct {
+	net.Conn
+
+	mut     sync.Mutex
+	timer   *time.Timer
+	expired bool
+}
+
+// NewMaxLifetimeConn returns a MaxLifetimeConn wrapping conn, closing it
+// after lifetime.
+func NewMaxLifetimeConn(conn net.Conn, lifetime time.Duration) *MaxLifetimeConn {
+	c := &MaxLifetimeConn{Conn: conn}
+	c.timer = time.AfterFunc(lifetime, c.expire)
+	return c
+}
+
+func (c *MaxLifetimeConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	return n, c.check(err)
+}
+
+func (c *MaxLifetimeConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	return n, c.check(err)
+}
+
+// Close closes the connection and stops the lifetime timer.
+func (c *MaxLifetimeConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
+
+// Unwrap returns the wrapped connection.
+func (c *MaxLifetimeConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// check replaces the error for a connection already closed for having
+// reached its lifetime.
+func (c *MaxLifetimeConn) check(err error) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if c.expired {
+		return ErrMaxLifetime
+	}
+	return err
+}
+
+func (c *MaxLifetimeConn) expire() {
+	c.mut.Lock()
+	c.expired = true
+	c.mut.Unlock()
+	c.Conn.Close()
+}
@@ -0,0 +1,213 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCountingConn(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &DowngradingListener{Listener: raw, CountBytes: true}
+	defer l.Close()
+
+	request := append([]byte("GET / HTTP/1.1\r\n\r\n"), bytes.Repeat([]byte("x"), 1000)...)
+	response := bytes.Repeat([]byte("y"), 500)
+
+	received := make(chan int, 1)
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			received <- 0
+			return
+		}
+		defer conn.Close()
+		conn.Write(request)
+		conn.(*net.TCPConn).CloseWrite()
+		bs, _ := ioutil.ReadAll(conn)
+		received <- len(bs)
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, request) {
+		t.Errorf("received %d bytes, expected the %d byte request", len(bs), len(request))
+	}
+	if _, err := conn.Write(response); err != nil {
+		t.Fatal(err)
+	}
+
+	counter, ok := ConnectionCounter(conn)
+	if !ok {
+		t.Fatalf("no counter found for %T", conn)
+	}
+	conn.Close()
+	if n := <-received; n != len(response) {
+		t.Errorf("client received %d bytes, expected %d", n, len(response))
+	}
+
+	// The bytes peeked to identify the connection are counted once.
+	if in := counter.BytesIn(); in != int64(len(request)) {
+		t.Errorf("counted %d bytes in, expected %d", in, len(request))
+	}
+	if out := counter.BytesOut(); out != int64(len(response)) {
+		t.Errorf("counted %d bytes out, expected %d", out, len(response))
+	}
+
+	// The counter is found underneath a TLS connection as well.
+	if c, ok := ConnectionCounter(tls.Server(conn, nil)); !ok || c != counter {
+		t.Error("counter not found through the TLS connection")
+	}
+}
+
+func TestIdleTimeoutConn(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+
+	t.Run("idle", func(t *testing.T) {
+		server, client := net.Pipe()
+		defer client.Close()
+		conn := NewIdleTimeoutConn(server, timeout)
+		defer conn.Close()
+
+		t0 := time.Now()
+		if _, err := conn.Read(make([]byte, 1)); err != ErrIdleTimeout {
+			t.Fatalf("unexpected error %v, expected ErrIdleTimeout", err)
+		}
+		if d := time.Since(t0); d < timeout {
+			t.Errorf("closed after %v, before the timeout", d)
+		}
+		if _, err := client.Write([]byte("late")); err == nil {
+			t.Error("connection should have been closed")
+		}
+		if _, err := conn.Write([]byte("late")); err != ErrIdleTimeout {
+			t.Errorf("unexpected write error %v, expected ErrIdleTimeout", err)
+		}
+	})
+
+	t.Run("active", func(t *testing.T) {
+		// A generous timeout compared to the activity, so that a slow
+		// machine doesn't make the connection look idle.
+		const timeout = time.Second
+		const interval = 10 * time.Millisecond
+		const writes = int(3 * timeout / 2 / interval)
+
+		server, client := net.Pipe()
+		defer client.Close()
+		conn := NewIdleTimeoutConn(server, timeout)
+		defer conn.Close()
+
+		go func() {
+			for i := 0; i < writes; i++ {
+				time.Sleep(interval)
+				if _, err := client.Write([]byte{byte(i)}); err != nil {
+					return
+				}
+			}
+		}()
+
+		// Reading for longer than the timeout keeps the connection open.
+		buf := make([]byte, 1)
+		for i := 0; i < writes; i++ {
+			if _, err := conn.Read(buf); err != nil {
+				t.Fatalf("read %d: %v", i, err)
+			}
+		}
+	})
+}
+
+func TestMaxLifetimeConn(t *testing.T) {
+	const lifetime = 200 * time.Millisecond
+
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := NewMaxLifetimeConn(server, lifetime)
+	defer conn.Close()
+
+	go func() {
+		for i := 0; ; i++ {
+			time.Sleep(lifetime / 10)
+			if _, err := client.Write([]byte{byte(i)}); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Constant activity doesn't keep the connection open past its lifetime.
+	t0 := time.Now()
+	buf := make([]byte, 1)
+	var err error
+	for err == nil {
+		_, err = conn.Read(buf)
+	}
+	if err != ErrMaxLifetime {
+		t.Fatalf("unexpected error %v, expected ErrMaxLifetime", err)
+	}
+	if d := time.Since(t0); d < lifetime {
+		t.Errorf("closed after %v, before the lifetime", d)
+	}
+	if _, err := conn.Write([]byte("late")); err != ErrMaxLifetime {
+		t.Errorf("unexpected write error %v, expected ErrMaxLifetime", err)
+	}
+}
+
+func TestConnectionID(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &DowngradingListener{Listener: raw, ConnectionUUIDs: true}
+	defer l.Close()
+
+	var lastID uint64
+	uuids := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		go func() {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		}()
+
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		uc := conn.(*UnionedConnection)
+		if id := uc.ID(); id <= lastID {
+			t.Errorf("connection %d got ID %d, after %d", i, id, lastID)
+		}
+		lastID = uc.ID()
+
+		// The ID is found underneath a TLS connection as well.
+		if id, ok := ConnectionID(tls.Server(conn, nil)); !ok || id != lastID {
+			t.Errorf("got ID %d, %v through the TLS connection, expected %d", id, ok, lastID)
+		}
+
+		uuid := uc.UUID()
+		if len(uuid) != 36 || uuid[14] != '4' || uuids[uuid] {
+			t.Errorf("unexpected UUID %q", uuid)
+		}
+		uuids[uuid] = true
+		conn.Close()
+	}
+}
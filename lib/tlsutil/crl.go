@@ -0,0 +1,142 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// LoadCRL reads a certificate revocation list in DER or PEM format.
+func LoadCRL(path string) (*x509.RevocationList, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(bs); block != nil {
+		if block.Type != "X509 CRL" {
+			return nil, fmt.Errorf("unexpected PEM block %q in CRL", block.Type)
+		}
+		bs = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(bs)
+	if err != nil {
+		return nil, fmt.Errorf("parse CRL: %s", err)
+	}
+	return crl, nil
+}
+
+// RejectRevoked returns a function for tls.Config.VerifyPeerCertificate that
+// rejects a peer whose certificate is listed in crl.
+func RejectRevoked(crl *x509.RevocationList) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		return checkRevoked(crl, rawCerts)
+	}
+}
+
+func checkRevoked(crl *x509.RevocationList, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return ErrNoCertificate
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(cert.RawIssuer, crl.RawIssuer) {
+		// Not covered by this CRL.
+		return nil
+	}
+	for _, entry := range crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return fmt.Errorf("certificate %s has been revoked", cert.SerialNumber)
+		}
+	}
+	return nil
+}
+
+// A CRLChecker rejects peers revoked by a CRL loaded from disk, which can be
+// reloaded while in use.
+type CRLChecker struct {
+	// Logger, if set, receives warnings about failed reloads and CRLs that
+	// are past their next update time. Set it before calling Reload or Run.
+	Logger Logger
+
+	path   string
+	issuer *x509.Certificate
+
+	mut sync.Mutex
+	crl *x509.RevocationList
+}
+
+// NewCRLChecker loads the CRL at path. If issuer is given, the CRL must be
+// signed by it.
+func NewCRLChecker(path string, issuer *x509.Certificate) (*CRLChecker, error) {
+	c := &CRLChecker{path: path, issuer: issuer}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the CRL again. If that fails the previous CRL stays in use.
+func (c *CRLChecker) Reload() error {
+	crl, err := c.load()
+	if err != nil {
+		loggerOrNop(c.Logger).Warnf("Reloading CRL %s: %v", c.path, err)
+		return err
+	}
+	if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+		loggerOrNop(c.Logger).Warnf("CRL %s is out of date; it should have been updated at %v", c.path, crl.NextUpdate)
+	}
+
+	c.mut.Lock()
+	c.crl = crl
+	c.mut.Unlock()
+	return nil
+}
+
+func (c *CRLChecker) load() (*x509.RevocationList, error) {
+	crl, err := LoadCRL(c.path)
+	if err != nil {
+		return nil, err
+	}
+	if c.issuer != nil {
+		if err := crl.CheckSignatureFrom(c.issuer); err != nil {
+			return nil, fmt.Errorf("CRL signature: %s", err)
+		}
+	}
+	return crl, nil
+}
+
+// Run reloads the CRL every interval until ctx is cancelled. Failures are
+// reported to the Logger.
+func (c *CRLChecker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Reload()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// VerifyPeerCertificate can be used as tls.Config.VerifyPeerCertificate.
+func (c *CRLChecker) VerifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	c.mut.Lock()
+	crl := c.crl
+	c.mut.Unlock()
+	return checkRevoked(crl, rawCerts)
+}
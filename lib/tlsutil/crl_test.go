@@ -0,0 +1,194 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCRL writes a CRL signed by ca revoking the given certificates.
+func writeTestCRL(t *testing.T, path string, ca *CA, usePEM bool, revoked ...tls.Certificate) {
+	template := &x509.RevocationList{
+		Number:     big.NewInt(time.Now().UnixNano()),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, cert := range revoked {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   cert.Leaf.SerialNumber,
+			RevocationTime: time.Now(),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.Cert, ca.Signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usePEM {
+		der = pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+	}
+	if err := ioutil.WriteFile(path, der, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCRL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, err := NewCA("ca", 0, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, err := SignCertificate(ca.Cert, ca.Signer, "good", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, err := SignCertificate(ca.Cert, ca.Signer, "bad", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, usePEM := range []bool{false, true} {
+		path := filepath.Join(dir, "crl")
+		writeTestCRL(t, path, ca, usePEM, bad)
+
+		crl, err := LoadCRL(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		verify := RejectRevoked(crl)
+		if err := verify(good.Certificate, nil); err != nil {
+			t.Errorf("PEM %v: good certificate rejected: %v", usePEM, err)
+		}
+		if err := verify(bad.Certificate, nil); err == nil {
+			t.Errorf("PEM %v: revoked certificate accepted", usePEM)
+		}
+	}
+}
+
+func TestCRLChecker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, err := NewCA("ca", 0, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := SignCertificate(ca.Cert, ca.Signer, "device", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "crl.pem")
+	writeTestCRL(t, path, ca, true)
+	checker, err := NewCRLChecker(path, ca.Cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCfg := &tls.Config{
+		Certificates:          []tls.Certificate{cert},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: checker.VerifyPeerCertificate,
+	}
+	clientCfg := &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+	}
+	if _, err := handshakeConfigs(serverCfg, clientCfg); err != nil {
+		t.Errorf("certificate not on CRL rejected: %v", err)
+	}
+
+	// Revoke the certificate.
+	writeTestCRL(t, path, ca, true, cert)
+	if err := checker.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handshakeConfigs(serverCfg, clientCfg); err == nil {
+		t.Error("revoked certificate accepted")
+	}
+
+	// A CRL from someone else is not accepted.
+	other, err := NewCA("other", 0, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestCRL(t, path, other, true)
+	if err := checker.Reload(); err == nil {
+		t.Error("CRL with incorrect signature loaded")
+	}
+	if _, err := handshakeConfigs(serverCfg, clientCfg); err == nil {
+		t.Error("previous CRL should still be in use")
+	}
+}
+
+func TestCRLCheckerLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, err := NewCA("ca", 0, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "crl.pem")
+	writeTestCRL(t, path, ca, true)
+	checker, err := NewCRLChecker(path, ca.Cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := new(testLogger)
+	checker.Logger = logger
+
+	// A CRL that can't be parsed.
+	if err := ioutil.WriteFile(path, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checker.Reload(); err == nil {
+		t.Error("broken CRL should not be loaded")
+	}
+
+	// One that should have been replaced an hour ago.
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-2 * time.Hour),
+		NextUpdate: time.Now().Add(-time.Hour),
+	}, ca.Cert, ca.Signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, der, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checker.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(logger.msgs) != 2 ||
+		!strings.HasPrefix(logger.msgs[0], "WARNING: Reloading CRL "+path) ||
+		!strings.HasPrefix(logger.msgs[1], "WARNING: CRL "+path+" is out of date") {
+		t.Errorf("unexpected log messages %q", logger.msgs)
+	}
+}
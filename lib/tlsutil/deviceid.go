@@ -0,0 +1,117 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/calmh/luhn"
+)
+
+// A DeviceID is the SHA-256 hash of a device's certificate, the same as
+// protocol.DeviceID.
+type DeviceID [32]byte
+
+// DeviceIDFromCertificate returns the device ID for the certificate.
+func DeviceIDFromCertificate(cert tls.Certificate) (DeviceID, error) {
+	fp, err := CertificateFingerprint(cert)
+	if err != nil {
+		return DeviceID{}, err
+	}
+	return DeviceID(fp), nil
+}
+
+// deviceIDFromRaw returns the device ID for a DER encoded certificate.
+func deviceIDFromRaw(rawCert []byte) DeviceID {
+	return DeviceID(sha256.Sum256(rawCert))
+}
+
+// ParseDeviceID parses a device ID in the format returned by String, or
+// the older format without check digits. As the ID is often typed in by
+// hand, case and the grouping are ignored, and the digits 0, 1 and 8 are
+// taken to be the letters O, I and B they are easily mistaken for.
+func ParseDeviceID(s string) (DeviceID, error) {
+	s = strings.ToUpper(strings.TrimRight(strings.TrimSpace(s), "="))
+	s = strings.NewReplacer("-", "", " ", "", "0", "O", "1", "I", "8", "B").Replace(s)
+
+	switch len(s) {
+	case 56:
+		var err error
+		if s, err = unluhnify(s); err != nil {
+			return DeviceID{}, err
+		}
+	case 52:
+		// Old style, without check digits.
+	default:
+		return DeviceID{}, errors.New("device ID invalid: incorrect length")
+	}
+
+	dec, err := base32.StdEncoding.DecodeString(s + "====")
+	if err != nil {
+		return DeviceID{}, fmt.Errorf("device ID invalid: %s", err)
+	}
+	var id DeviceID
+	copy(id[:], dec)
+	return id, nil
+}
+
+// String returns the device ID in its canonical format, as groups of seven
+// characters with a Luhn check digit after every thirteen.
+func (id DeviceID) String() string {
+	s := luhnify(strings.TrimRight(base32.StdEncoding.EncodeToString(id[:]), "="))
+
+	// Split into groups of seven characters.
+	groups := make([]string, 0, 8)
+	for i := 0; i < len(s); i += 7 {
+		groups = append(groups, s[i:i+7])
+	}
+	return strings.Join(groups, "-")
+}
+
+// Short returns the first group of the device ID, which is enough to tell
+// devices apart in logs.
+func (id DeviceID) Short() string {
+	return id.String()[:7]
+}
+
+// luhnify adds a Luhn check digit after each of the four 13 character parts
+// of the base32 encoded device ID.
+func luhnify(s string) string {
+	var luhnified string
+	for i := 0; i < 4; i++ {
+		p := s[i*13 : (i+1)*13]
+		l, err := luhn.Base32.Generate(p)
+		if err != nil {
+			// Should never happen, base32 is the Luhn alphabet.
+			panic(err)
+		}
+		luhnified += fmt.Sprintf("%s%c", p, l)
+	}
+	return luhnified
+}
+
+// unluhnify verifies and removes the check digits added by luhnify.
+func unluhnify(s string) (string, error) {
+	var res string
+	for i := 0; i < 4; i++ {
+		p := s[i*14 : (i+1)*14-1]
+		l, err := luhn.Base32.Generate(p)
+		if err != nil {
+			return "", fmt.Errorf("device ID invalid: %s", err)
+		}
+		if s[(i+1)*14-1] != byte(l) {
+			return "", errors.New("device ID invalid: incorrect check digit")
+		}
+		res += p
+	}
+	return res, nil
+}
@@ -0,0 +1,95 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+// The device ID of testdata/cert.pem, as given by protocol.NewDeviceID.
+const fixtureDeviceID = "7REFMDR-MZIECTR-JDC37XT-MCMP2D6-ELYLXK2-XLRQFQM-WLIQNML-JBHNTAG"
+
+func TestDeviceIDFromCertificate(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := DeviceIDFromCertificate(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.String() != fixtureDeviceID {
+		t.Errorf("incorrect device ID %s != %s", id, fixtureDeviceID)
+	}
+}
+
+func TestParseDeviceID(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := DeviceIDFromCertificate(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := []string{
+		fixtureDeviceID,
+		"7refmdr-mziectr-jdc37xt-mcmp2d6-elylxk2-xlrqfqm-wliqnml-jbhntag",
+		"7REFMDRMZIECTRJDC37XTMCMP2D6ELYLXK2XLRQFQMWLIQNMLJBHNTAG",
+		"7REFMDR MZIECTR JDC37XT MCMP2D6 ELYLXK2 XLRQFQM WLIQNML JBHNTAG",
+		// Typos of O, I and B.
+		"7REFMDR-MZ1ECTR-JDC37XT-MCMP2D6-ELYLXK2-XLRQFQM-WL1QNML-J8HNTAG",
+		// Without check digits.
+		"7REFMDRMZIECTJDC37XTMCMP2DELYLXK2XLRQFQWLIQNMLJBHNTA",
+	}
+	for _, s := range valid {
+		id, err := ParseDeviceID(s)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", s, err)
+			continue
+		}
+		if id != expected {
+			t.Errorf("%q: parsed as %s, expected %s", s, id, expected)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"7REFMDR-MZIECTR",
+		// Incorrect check digit in the first group.
+		"7REFMDR-MZIECTS-JDC37XT-MCMP2D6-ELYLXK2-XLRQFQM-WLIQNML-JBHNTAG",
+		// Characters outside the base32 alphabet.
+		"7REFMDR-MZIECTR-JDC37XT-MCMP2D6-ELYLXK2-XLRQFQM-WLIQNML-JBHNTA!",
+	}
+	for _, s := range invalid {
+		if _, err := ParseDeviceID(s); err == nil {
+			t.Errorf("%q: unexpected nil error", s)
+		}
+	}
+}
+
+func TestDeviceIDString(t *testing.T) {
+	id, err := DeviceIDFromCertificate(TestCertificate())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseDeviceID(id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != id {
+		t.Errorf("round trip of %s gave %s", id, parsed)
+	}
+
+	if short := id.Short(); short != id.String()[:7] || len(short) != 7 {
+		t.Errorf("short ID %q is not the first group of %s", short, id)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+)
+
+// happyEyeballsDelay is how long DialTLSHappyEyeballs gives a connection
+// attempt before starting the next one in parallel; the same as net.Dialer
+// uses between IPv6 and IPv4.
+const happyEyeballsDelay = 300 * time.Millisecond
+
+// DialTLSHappyEyeballs connects to the first of addrs that completes a TLS
+// handshake. The addresses are tried in order, with each attempt getting a
+// head start of a few hundred milliseconds before the next one is started
+// in parallel, or immediately after the previous one fails. The remaining
+// attempts are abandoned once one succeeds. If all fail, the first error is
+// returned.
+func DialTLSHappyEyeballs(ctx context.Context, addrs []string, cfg *tls.Config) (*tls.Conn, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses to dial")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn *tls.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	dial := func(addr string) {
+		d := &tls.Dialer{Config: cfg}
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		results <- result{conn: conn.(*tls.Conn)}
+	}
+
+	// closeLate closes the connections of attempts still pending when we
+	// return, should they succeed after all.
+	closeLate := func(pending int) {
+		go func() {
+			for i := 0; i < pending; i++ {
+				if res := <-results; res.conn != nil {
+					res.conn.Close()
+				}
+			}
+		}()
+	}
+
+	// The timer starts the next attempt; the first one right away.
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	var firstErr error
+	next, pending := 0, 0
+	for {
+		select {
+		case <-timer.C:
+			if next == len(addrs) {
+				continue
+			}
+			go dial(addrs[next])
+			next++
+			pending++
+			if next < len(addrs) {
+				timer.Reset(happyEyeballsDelay)
+			}
+
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				closeLate(pending)
+				return res.conn, nil
+			}
+
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if next < len(addrs) {
+				// No point in waiting for the failed attempt's head start.
+				timer.Reset(0)
+			} else if pending == 0 {
+				if err := ctx.Err(); err != nil {
+					// The attempts failed because we ran out of time.
+					return nil, err
+				}
+				return nil, firstErr
+			}
+
+		case <-ctx.Done():
+			closeLate(pending)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// SecureDial connects to addr and performs the TLS handshake using
+// DialConfig, so the connection is established only if the server presents
+// the expected device ID. The handshake is limited by
+// DefaultHandshakeTimeout, and is abandoned when ctx is done.
+func SecureDial(ctx context.Context, network, addr string, myCert tls.Certificate, expectedDeviceID string) (*tls.Conn, error) {
+	var d net.Dialer
+	raw, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, DefaultHandshakeTimeout)
+	defer cancel()
+	conn := tls.Client(raw, DialConfig(myCert, expectedDeviceID))
+	if err := conn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,158 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+// newDeadListener returns a listener that accepts TCP connections (in the
+// kernel) but never responds, like a host behind a broken route.
+func newDeadListener(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// newTLSServer returns a listener that completes the TLS handshake with
+// every client.
+func newTLSServer(t *testing.T, cfg *tls.Config) net.Listener {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Read(make([]byte, 1))
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestDialTLSHappyEyeballs(t *testing.T) {
+	dead := newDeadListener(t)
+	defer dead.Close()
+	live := newTLSServer(t, &tls.Config{Certificates: []tls.Certificate{TestCertificate()}})
+	defer live.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t0 := time.Now()
+	conn, err := DialTLSHappyEyeballs(ctx, []string{dead.Addr().String(), live.Addr().String()}, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if d := time.Since(t0); d > 2*time.Second {
+		t.Errorf("took %v to connect", d)
+	}
+	if conn.RemoteAddr().String() != live.Addr().String() {
+		t.Errorf("connected to %v, expected the live server at %v", conn.RemoteAddr(), live.Addr())
+	}
+}
+
+func TestDialTLSHappyEyeballsFailures(t *testing.T) {
+	// A port nobody listens on.
+	refused := newDeadListener(t)
+	refusedAddr := refused.Addr().String()
+	refused.Close()
+
+	if _, err := DialTLSHappyEyeballs(context.Background(), []string{refusedAddr, refusedAddr}, &tls.Config{}); err == nil {
+		t.Error("unexpected nil error dialing closed ports")
+	}
+
+	if _, err := DialTLSHappyEyeballs(context.Background(), nil, &tls.Config{}); err == nil {
+		t.Error("unexpected nil error without addresses")
+	}
+
+	dead := newDeadListener(t)
+	defer dead.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	t0 := time.Now()
+	if _, err := DialTLSHappyEyeballs(ctx, []string{dead.Addr().String()}, &tls.Config{}); err != context.DeadlineExceeded {
+		t.Errorf("unexpected error %v, expected DeadlineExceeded", err)
+	}
+	if d := time.Since(t0); d > 2*time.Second {
+		t.Errorf("took %v to give up, after the context deadline", d)
+	}
+}
+
+func TestSecureDial(t *testing.T) {
+	serverCert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTLSServer(t, SecureDefaultTLSConfig(serverCert))
+	defer server.Close()
+
+	otherID, err := DeviceIDFromCertificate(TestCertificate())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := SecureDial(ctx, "tcp", server.Addr().String(), TestCertificate(), fixtureDeviceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conn.ConnectionState().HandshakeComplete {
+		t.Error("handshake not complete")
+	}
+	conn.Close()
+
+	if _, err := SecureDial(ctx, "tcp", server.Addr().String(), TestCertificate(), otherID.String()); err == nil {
+		t.Error("unexpected nil error for a server with the wrong device ID")
+	}
+}
+
+func TestSecureDialCancel(t *testing.T) {
+	// The server accepts the connection but never answers the ClientHello.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	t0 := time.Now()
+	if _, err := SecureDial(ctx, "tcp", l.Addr().String(), TestCertificate(), fixtureDeviceID); err == nil {
+		t.Fatal("unexpected nil error for a stalled handshake")
+	}
+	if d := time.Since(t0); d > 2*time.Second {
+		t.Errorf("took %v to give up, after the context was cancelled", d)
+	}
+}
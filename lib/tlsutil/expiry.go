@@ -0,0 +1,29 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+// TimeUntilExpiry returns the time remaining until the leaf certificate
+// expires. It is negative for an already expired certificate.
+func TimeUntilExpiry(cert tls.Certificate) (time.Duration, error) {
+	leaf, err := leafCertificate(cert)
+	if err != nil {
+		return 0, err
+	}
+	return leaf.NotAfter.Sub(time.Now()), nil
+}
+
+// IsExpired returns true if the leaf certificate has expired. A certificate
+// that can't be parsed is considered expired.
+func IsExpired(cert tls.Certificate) bool {
+	d, err := TimeUntilExpiry(cert)
+	return err != nil || d <= 0
+}
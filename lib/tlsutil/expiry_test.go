@@ -0,0 +1,48 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+func TestExpiry(t *testing.T) {
+	ca, err := NewCA("syncthing ca", 0, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := SignCertificate(ca.Cert, ca.Signer, "device", nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Force parsing of the certificate.
+	cert.Leaf = nil
+
+	d, err := TimeUntilExpiry(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Certificate times have a one second resolution.
+	if d > time.Second || d < -time.Second {
+		t.Errorf("unexpected time until expiry %v", d)
+	}
+
+	time.Sleep(d + time.Second)
+
+	if !IsExpired(cert) {
+		t.Error("certificate should have expired")
+	}
+	if d, _ := TimeUntilExpiry(cert); d >= 0 {
+		t.Errorf("unexpected time until expiry %v for expired certificate", d)
+	}
+
+	if !IsExpired(tls.Certificate{}) {
+		t.Error("missing certificate should count as expired")
+	}
+}
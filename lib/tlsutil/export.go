@@ -0,0 +1,55 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+)
+
+var ErrNoPrivateKey = errors.New("no usable private key present")
+
+// CertificatePEM returns the certificate chain in PEM format, leaf first, as
+// it would be written to a certificate file.
+func CertificatePEM(cert tls.Certificate) ([]byte, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, ErrNoCertificate
+	}
+	var buf bytes.Buffer
+	for _, der := range cert.Certificate {
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// CertificateDER returns the leaf certificate in DER format.
+func CertificateDER(cert tls.Certificate) ([]byte, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, ErrNoCertificate
+	}
+	return append([]byte(nil), cert.Certificate[0]...), nil
+}
+
+// PrivateKeyPEM returns the private key in PEM format, the same way
+// NewCertificate and friends write it: PKCS#1 for RSA keys, SEC 1 for ECDSA
+// keys and PKCS#8 for Ed25519 keys.
+func PrivateKeyPEM(cert tls.Certificate) ([]byte, error) {
+	priv, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, ErrNoPrivateKey
+	}
+	block, err := marshalPrivateKey(priv, CertificateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(block), nil
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExportCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	rsaCert, err := NewCertificateInMemory("rsa", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaCert, err := NewCertificateECDSA(certFile, keyFile, "ecdsa", elliptic.P256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519Cert, err := NewCertificateEd25519(certFile, keyFile, "ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cert := range []tls.Certificate{rsaCert, ecdsaCert, ed25519Cert} {
+		name := cert.Leaf.Subject.CommonName
+
+		certPEM, err := CertificatePEM(cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyPEM, err := PrivateKeyPEM(cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadKeyPairFromPEM(certPEM, keyPEM)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(loaded.Certificate, cert.Certificate) {
+			t.Errorf("%s: certificate differs after round trip", name)
+		}
+		if !reflect.DeepEqual(loaded.PrivateKey, cert.PrivateKey) {
+			t.Errorf("%s: private key differs after round trip", name)
+		}
+
+		der, err := CertificateDER(cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(parsed.Raw, cert.Leaf.Raw) {
+			t.Errorf("%s: DER differs", name)
+		}
+	}
+
+	if _, err := CertificatePEM(tls.Certificate{}); err != ErrNoCertificate {
+		t.Errorf("unexpected error %v for empty certificate", err)
+	}
+	if _, err := PrivateKeyPEM(tls.Certificate{}); err != ErrNoPrivateKey {
+		t.Errorf("unexpected error %v for missing key", err)
+	}
+}
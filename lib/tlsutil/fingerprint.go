@@ -0,0 +1,73 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrNoCertificate = errors.New("no certificate present")
+
+// CertificateFingerprint returns the SHA-256 hash of the DER encoded leaf
+// certificate.
+func CertificateFingerprint(cert tls.Certificate) ([32]byte, error) {
+	leaf, err := leafCertificate(cert)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return sha256.Sum256(leaf.Raw), nil
+}
+
+// FingerprintString returns the SHA-256 fingerprint of the leaf certificate
+// as colon separated hex, in the same format as "openssl x509 -fingerprint
+// -sha256".
+func FingerprintString(cert tls.Certificate) (string, error) {
+	fp, err := CertificateFingerprint(cert)
+	if err != nil {
+		return "", err
+	}
+
+	parts := make([]string, len(fp))
+	for i, b := range fp {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":"), nil
+}
+
+// CertificatesEqual returns true if a and b have the same leaf certificate.
+// The comparison takes the same time regardless of where the certificates
+// differ. Certificates without a leaf are never equal.
+func CertificatesEqual(a, b tls.Certificate) bool {
+	if len(a.Certificate) == 0 || len(b.Certificate) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare(a.Certificate[0], b.Certificate[0]) == 1
+}
+
+// FingerprintsEqual compares two fingerprints, or device IDs, in constant
+// time.
+func FingerprintsEqual(a, b [32]byte) bool {
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// leafCertificate returns the parsed leaf certificate, parsing it if the
+// Leaf field is not already set.
+func leafCertificate(cert tls.Certificate) (*x509.Certificate, error) {
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, ErrNoCertificate
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
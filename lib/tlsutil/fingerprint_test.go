@@ -0,0 +1,82 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+// Computed with "openssl x509 -in testdata/cert.pem -noout -fingerprint -sha256"
+const fixtureFingerprint = "FC:48:56:0E:2C:CA:08:29:A4:62:DF:EF:36:09:8F:D0:C8:BC:2E:EA:D5:D7:18:16:16:5A:20:D6:2D:21:3B:66"
+
+func TestFingerprintString(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure we handle both a parsed and an unparsed leaf.
+	for _, leaf := range []bool{true, false} {
+		if !leaf {
+			cert.Leaf = nil
+		}
+		fp, err := FingerprintString(cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fp != fixtureFingerprint {
+			t.Errorf("incorrect fingerprint %s != %s", fp, fixtureFingerprint)
+		}
+	}
+}
+
+func TestFingerprintNoCertificate(t *testing.T) {
+	if _, err := CertificateFingerprint(tls.Certificate{}); err != ErrNoCertificate {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestCertificatesEqual(t *testing.T) {
+	a, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := TestCertificate()
+
+	cases := []struct {
+		a, b  tls.Certificate
+		equal bool
+	}{
+		{a, b, true},
+		{a, other, false},
+		{other, other, true},
+		{a, tls.Certificate{}, false},
+		{tls.Certificate{}, tls.Certificate{}, false},
+	}
+	for i, tc := range cases {
+		if eq := CertificatesEqual(tc.a, tc.b); eq != tc.equal {
+			t.Errorf("case %d: equal %v, expected %v", i, eq, tc.equal)
+		}
+	}
+
+	fpA, _ := CertificateFingerprint(a)
+	fpOther, _ := CertificateFingerprint(other)
+	if !FingerprintsEqual(fpA, fpA) {
+		t.Error("fingerprint not equal to itself")
+	}
+	if FingerprintsEqual(fpA, fpOther) {
+		t.Error("different fingerprints compare equal")
+	}
+	if FingerprintsEqual(fpA, [32]byte{}) {
+		t.Error("fingerprint equal to zero value")
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import "crypto/tls"
+
+// Info describes an established TLS connection.
+type Info struct {
+	Version            string   // "1.2", "1.3", ...
+	CipherSuite        string   // as given by tls.CipherSuiteName
+	NegotiatedProtocol string   // empty if there was no ALPN agreement
+	PeerDeviceID       DeviceID // zero if the peer sent no certificate
+}
+
+// ConnectionInfo returns the details of conn, performing the handshake if it
+// hasn't been already.
+func ConnectionInfo(conn *tls.Conn) (Info, error) {
+	if err := conn.Handshake(); err != nil {
+		return Info{}, err
+	}
+
+	state := conn.ConnectionState()
+	info := Info{
+		Version:            versionName(state.Version),
+		CipherSuite:        tls.CipherSuiteName(state.CipherSuite),
+		NegotiatedProtocol: state.NegotiatedProtocol,
+	}
+	if len(state.PeerCertificates) > 0 {
+		info.PeerDeviceID = deviceIDFromRaw(state.PeerCertificates[0].Raw)
+	}
+	return info, nil
+}
@@ -0,0 +1,73 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+func TestConnectionInfo(t *testing.T) {
+	clientCert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCfg := WithALPN(SecureDefaultTLSConfig(TestCertificate()), "bep/1.0")
+	serverCfg.ClientAuth = tls.RequireAnyClientCert
+
+	list, err := tls.Listen("tcp", "127.0.0.1:0", serverCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := tls.Dial("tcp", list.Addr().String(), &tls.Config{
+			Certificates:       []tls.Certificate{clientCert},
+			InsecureSkipVerify: true,
+			MaxVersion:         tls.VersionTLS12,
+			NextProtos:         []string{"bep/1.0"},
+		})
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+		// Wait for the server to close the connection.
+		conn.Read(make([]byte, 1))
+		errs <- nil
+	}()
+
+	conn, err := list.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := ConnectionInfo(conn.(*tls.Conn))
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Version != "1.2" {
+		t.Errorf("incorrect version %q", info.Version)
+	}
+	if !strings.HasPrefix(info.CipherSuite, "TLS_ECDHE_ECDSA_") {
+		t.Errorf("incorrect cipher suite %q", info.CipherSuite)
+	}
+	if info.NegotiatedProtocol != "bep/1.0" {
+		t.Errorf("incorrect protocol %q", info.NegotiatedProtocol)
+	}
+	if info.PeerDeviceID.String() != fixtureDeviceID {
+		t.Errorf("incorrect device ID %s != %s", info.PeerDeviceID, fixtureDeviceID)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// KeyLogFileEnv is the environment variable EnableKeyLog looks at when not
+// given a path, as understood by Wireshark and most browsers.
+const KeyLogFileEnv = "SSLKEYLOGFILE"
+
+// EnableKeyLog makes cfg append the session secrets of its connections to
+// the file at path, or the file named by KeyLogFileEnv if path is empty, in
+// the NSS key log format. Anyone with access to the file can decrypt the
+// traffic, so it's for debugging only and a warning is logged when enabled.
+// When neither is set EnableKeyLog does nothing. The returned Closer closes
+// the file, after which the secrets of new connections are lost.
+func EnableKeyLog(cfg *tls.Config, path string, logger Logger) (io.Closer, error) {
+	if path == "" {
+		path = os.Getenv(KeyLogFileEnv)
+	}
+	if path == "" {
+		return nopCloser{}, nil
+	}
+
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open key log: %s", err)
+	}
+	if _, err := fmt.Fprintf(fd, "# WARNING: TLS session keys, anyone with this file can decrypt the traffic\n"); err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("write key log: %s", err)
+	}
+
+	if logger != nil {
+		logger.Warnf("Logging TLS session keys to %s; connections can be decrypted by anyone with access to it", path)
+	}
+	w := &keyLogWriter{fd: fd}
+	cfg.KeyLogWriter = w
+	return w, nil
+}
+
+// A keyLogWriter serializes the writes of concurrent handshakes, so that
+// lines are never interleaved.
+type keyLogWriter struct {
+	mut sync.Mutex
+	fd  *os.File
+}
+
+func (w *keyLogWriter) Write(line []byte) (int, error) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	return w.fd.Write(line)
+}
+
+func (w *keyLogWriter) Close() error {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	return w.fd.Close()
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnableKeyLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys.log")
+	logger := &testLogger{}
+	clientCfg := &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}
+	closer, err := EnableKeyLog(clientCfg, path, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCfg := &tls.Config{Certificates: []tls.Certificate{TestCertificate()}}
+	if _, err := handshakeConfigs(serverCfg, clientCfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := closer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(bs)), "\n")
+	if !strings.HasPrefix(lines[0], "# WARNING") {
+		t.Errorf("missing warning header, got %q", lines[0])
+	}
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "CLIENT_RANDOM ") {
+		t.Errorf("expected one CLIENT_RANDOM line, got %q", lines[1:])
+	}
+	if len(logger.msgs) != 1 || !strings.HasPrefix(logger.msgs[0], "WARNING: ") {
+		t.Errorf("expected a warning to be logged, got %q", logger.msgs)
+	}
+}
+
+func TestEnableKeyLogUnset(t *testing.T) {
+	defer os.Setenv(KeyLogFileEnv, os.Getenv(KeyLogFileEnv))
+	os.Unsetenv(KeyLogFileEnv)
+
+	cfg := &tls.Config{}
+	closer, err := EnableKeyLog(cfg, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.KeyLogWriter != nil {
+		t.Error("key log should not be enabled")
+	}
+	if err := closer.Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A LimitListener limits the connections accepted from the listener it
+// wraps, to protect against connection floods. Use it as the Listener of a
+// DowngradingListener, so that excess connections are handled before any
+// data is read from them and the accepted connections keep their types.
+type LimitListener struct {
+	net.Listener
+
+	// MaxConns is the maximum number of accepted connections open at the
+	// same time. The zero value means no limit.
+	MaxConns int
+
+	// Rate is the maximum number of connections accepted per second, on
+	// average, with bursts of up to Burst connections (at least one). The
+	// zero value means no limit.
+	Rate  float64
+	Burst int
+
+	// Reject makes Accept close new connections immediately while a limit
+	// is reached. By default Accept waits instead, leaving them queued in
+	// the listen backlog.
+	Reject bool
+
+	initOnce  sync.Once
+	slots     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// mut protects the token bucket for the rate limit.
+	mut    sync.Mutex
+	tokens float64
+	last   time.Time
+
+	rejectedCount atomic.Int64
+}
+
+func (l *LimitListener) init() {
+	l.initOnce.Do(func() {
+		if l.MaxConns > 0 {
+			l.slots = make(chan struct{}, l.MaxConns)
+		}
+		l.done = make(chan struct{})
+	})
+}
+
+// Accept waits for and returns the next connection within the limits. The
+// connection counts towards MaxConns until it's closed.
+func (l *LimitListener) Accept() (net.Conn, error) {
+	l.init()
+	for {
+		if !l.Reject {
+			if err := l.wait(); err != nil {
+				return nil, err
+			}
+		}
+
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if !l.Reject {
+				l.release()
+			}
+			return nil, err
+		}
+
+		if l.Reject && !l.admit() {
+			conn.Close()
+			l.rejectedCount.Add(1)
+			continue
+		}
+		return &limitConn{Conn: conn, l: l}, nil
+	}
+}
+
+// Close closes the listener, which also makes a waiting Accept return.
+func (l *LimitListener) Close() error {
+	l.init()
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+// RejectedCount returns the number of connections closed for exceeding a
+// limit, with Reject set.
+func (l *LimitListener) RejectedCount() int64 {
+	return l.rejectedCount.Load()
+}
+
+// wait takes a connection slot and a rate token, waiting for them as
+// necessary, unless the listener is closed first.
+func (l *LimitListener) wait() error {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-l.done:
+			return net.ErrClosed
+		}
+	}
+	if l.Rate > 0 {
+		if d, _ := l.take(time.Now(), true); d > 0 {
+			timer := time.NewTimer(d)
+			select {
+			case <-timer.C:
+			case <-l.done:
+				timer.Stop()
+				l.release()
+				return net.ErrClosed
+			}
+		}
+	}
+	return nil
+}
+
+// admit takes a connection slot and a rate token if both are available
+// right away, and returns false otherwise.
+func (l *LimitListener) admit() bool {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	if l.Rate > 0 {
+		if _, ok := l.take(time.Now(), false); !ok {
+			l.release()
+			return false
+		}
+	}
+	return true
+}
+
+// release returns a connection slot.
+func (l *LimitListener) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// take takes a token from the rate limit bucket. If none is available and
+// wait is set, the token is reserved and the time until it would have been
+// available is returned; otherwise take returns false.
+func (l *LimitListener) take(now time.Time, wait bool) (time.Duration, bool) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	burst := float64(l.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	if l.last.IsZero() {
+		l.tokens = burst
+	} else if l.tokens += now.Sub(l.last).Seconds() * l.Rate; l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, true
+	}
+	if !wait {
+		return 0, false
+	}
+	d := time.Duration((1 - l.tokens) / l.Rate * float64(time.Second))
+	l.tokens--
+	return d, true
+}
+
+// A limitConn gives its connection slot back to the LimitListener when
+// closed.
+type limitConn struct {
+	net.Conn
+	l    *LimitListener
+	once sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.l.release)
+	return err
+}
+
+// Unwrap returns the wrapped connection.
+func (c *limitConn) Unwrap() net.Conn {
+	return c.Conn
+}
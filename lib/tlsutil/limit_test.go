@@ -0,0 +1,197 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// newLimitListener returns a LimitListener on a TCP listener, configured by
+// fn.
+func newLimitListener(t *testing.T, fn func(*LimitListener)) *LimitListener {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &LimitListener{Listener: raw}
+	fn(l)
+	return l
+}
+
+func dialMany(t *testing.T, addr net.Addr, n int) []net.Conn {
+	var conns []net.Conn
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+func TestLimitListenerMaxConns(t *testing.T) {
+	l := newLimitListener(t, func(l *LimitListener) { l.MaxConns = 2 })
+	defer l.Close()
+	for _, conn := range dialMany(t, l.Addr(), 3) {
+		defer conn.Close()
+	}
+
+	first, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The third connection waits for one of the others to close.
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case <-accepted:
+		t.Fatal("connection accepted over the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	first.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("connection not accepted after another closed")
+	}
+}
+
+func TestLimitListenerReject(t *testing.T) {
+	l := newLimitListener(t, func(l *LimitListener) {
+		l.MaxConns = 1
+		l.Reject = true
+	})
+	defer l.Close()
+
+	conns := dialMany(t, l.Addr(), 1)
+	defer conns[0].Close()
+	first, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The excess connections are closed right away, while Accept keeps
+	// waiting for one within the limit.
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	for _, conn := range dialMany(t, l.Addr(), 2) {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Error("excess connection should have been closed")
+		}
+		conn.Close()
+	}
+	if n := l.RejectedCount(); n != 2 {
+		t.Errorf("rejected %d connections, expected 2", n)
+	}
+
+	first.Close()
+	last := dialMany(t, l.Addr(), 1)
+	defer last[0].Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("connection not accepted after another closed")
+	}
+}
+
+func TestLimitListenerRate(t *testing.T) {
+	l := newLimitListener(t, func(l *LimitListener) { l.Rate = 20 })
+	defer l.Close()
+	for _, conn := range dialMany(t, l.Addr(), 4) {
+		defer conn.Close()
+	}
+
+	// The first connection is accepted right away, then one every 50 ms.
+	t0 := time.Now()
+	for i := 0; i < 4; i++ {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if d := time.Since(t0); d < 140*time.Millisecond {
+		t.Errorf("accepted 4 connections in %v at 20 per second", d)
+	}
+}
+
+func TestLimitListenerClose(t *testing.T) {
+	l := newLimitListener(t, func(l *LimitListener) { l.MaxConns = 1 })
+	conns := dialMany(t, l.Addr(), 1)
+	defer conns[0].Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	l.Close()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("unexpected nil error from Accept on a closed listener")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Accept did not return after Close")
+	}
+}
+
+func TestLimitListenerUnderDowngradingListener(t *testing.T) {
+	l := &DowngradingListener{
+		Listener: newLimitListener(t, func(l *LimitListener) { l.MaxConns = 1 }),
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+			conn.Read(make([]byte, 1))
+			conn.Close()
+		}
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	uc, ok := conn.(*UnionedConnection)
+	if !ok {
+		t.Fatalf("accepted %T, expected *UnionedConnection", conn)
+	}
+	if _, ok := baseConn(uc.Unwrap()).(*net.TCPConn); !ok {
+		t.Error("TCP connection should be reachable below the limit wrapper")
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"syscall"
+)
+
+// Listen creates a listener on the network address, with SO_REUSEADDR set
+// on the socket and SO_REUSEPORT as well where the platform supports it,
+// and wraps it in a DowngradingListener using the TLS configuration. With
+// SO_REUSEPORT several listeners, in the same process or others, can bind
+// the same port and share its incoming connections, allowing a restart
+// without refusing connections or sharding across processes. Elsewhere the
+// listener is created without it, and a second one fails to bind as usual.
+func Listen(network, address string, tlsCfg *tls.Config) (*DowngradingListener, error) {
+	lc := net.ListenConfig{Control: controlReuse}
+	l, err := lc.Listen(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &DowngradingListener{Listener: l, TLSConfig: tlsCfg}, nil
+}
+
+// controlReuse sets the socket reuse options before the socket is bound.
+func controlReuse(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = setReuseOptions(fd)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
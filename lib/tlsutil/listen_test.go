@@ -0,0 +1,69 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+func TestListenReusePort(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT is not supported on this platform")
+	}
+
+	cfg := &tls.Config{Certificates: []tls.Certificate{TestCertificate()}}
+	first, err := Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	// A second listener binds the same port.
+	addr := first.Addr().String()
+	second, err := Listen("tcp", addr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if second.Addr().String() != addr {
+		t.Errorf("second listener on %v, expected %v", second.Addr(), addr)
+	}
+
+	// The port keeps accepting connections when the first one goes away.
+	first.Close()
+	go func() {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Handshake()
+	}()
+	conn, err := second.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*tls.Conn); !ok {
+		t.Errorf("got %T, expected a TLS connection", conn)
+	}
+}
+
+func TestListenWithoutReusePort(t *testing.T) {
+	// Listeners created without Listen still own their port.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l2, err := Listen("tcp", l.Addr().String(), nil); err == nil {
+		l2.Close()
+		t.Error("listener should not bind a port in exclusive use")
+	}
+}
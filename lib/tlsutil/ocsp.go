@@ -0,0 +1,214 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+var (
+	ErrNoOCSPServer = errors.New("certificate has no OCSP server")
+	ErrNoIssuer     = errors.New("issuer certificate unknown")
+)
+
+const (
+	// How often to refresh a staple without a next update time.
+	ocspDefaultRefresh = 1 * time.Hour
+	// How soon to retry after a failed refresh.
+	ocspRetryInterval = 1 * time.Minute
+	// The maximum size of a response we accept from an OCSP server.
+	ocspMaxResponseSize = 1 << 20
+)
+
+// mustStapleFeature is the value of the TLS feature extension requiring
+// the status_request feature (RFC 7633): a sequence holding the integer 5.
+var mustStapleFeature = []byte{0x30, 0x03, 0x02, 0x01, 0x05}
+
+var oidTLSFeature = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+var ocspHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// An OCSPStapler keeps an OCSP response stapled to a certificate. Use its
+// GetCertificate method in tls.Config and call Run to keep the response
+// fresh. Certificates without an OCSP server, like the usual self signed
+// device certificates, are served without a staple.
+type OCSPStapler struct {
+	mut        sync.Mutex
+	cert       tls.Certificate
+	issuer     *x509.Certificate
+	nextUpdate time.Time
+}
+
+// NewOCSPStapler returns a stapler for cert. If issuer is nil, it's taken
+// from the certificate chain.
+func NewOCSPStapler(cert tls.Certificate, issuer *x509.Certificate) (*OCSPStapler, error) {
+	if issuer == nil && len(cert.Certificate) > 1 {
+		var err error
+		issuer, err = x509.ParseCertificate(cert.Certificate[1])
+		if err != nil {
+			return nil, fmt.Errorf("parse issuer: %s", err)
+		}
+	}
+	return &OCSPStapler{cert: cert, issuer: issuer}, nil
+}
+
+// GetCertificate returns the certificate with the current OCSP response,
+// if any.
+func (s *OCSPStapler) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	cert := s.cert
+	return &cert, nil
+}
+
+// Refresh fetches and staples a new OCSP response. It does nothing if the
+// certificate has no OCSP server.
+func (s *OCSPStapler) Refresh() error {
+	s.mut.Lock()
+	cert, issuer := s.cert, s.issuer
+	s.mut.Unlock()
+
+	leaf, err := leafCertificate(cert)
+	if err != nil {
+		return err
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil
+	}
+
+	resp, nextUpdate, err := FetchOCSPResponse(leaf, issuer)
+	if err != nil {
+		return err
+	}
+
+	s.mut.Lock()
+	s.cert.OCSPStaple = resp
+	s.nextUpdate = nextUpdate
+	s.mut.Unlock()
+	return nil
+}
+
+// Run refreshes the OCSP response halfway to its expiry, until ctx is
+// cancelled. A response that expires without being successfully refreshed
+// is removed.
+func (s *OCSPStapler) Run(ctx context.Context) {
+	for {
+		var wait time.Duration
+		if err := s.Refresh(); err != nil {
+			wait = ocspRetryInterval
+			s.dropExpired()
+		} else {
+			wait = s.refreshInterval()
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *OCSPStapler) refreshInterval() time.Duration {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.nextUpdate.IsZero() {
+		return ocspDefaultRefresh
+	}
+	if wait := time.Until(s.nextUpdate) / 2; wait > ocspRetryInterval {
+		return wait
+	}
+	return ocspRetryInterval
+}
+
+func (s *OCSPStapler) dropExpired() {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if !s.nextUpdate.IsZero() && time.Now().After(s.nextUpdate) {
+		s.cert.OCSPStaple = nil
+		s.nextUpdate = time.Time{}
+	}
+}
+
+// FetchOCSPResponse requests the status of leaf from its OCSP server and
+// returns the response, if it's validly signed and says the certificate is
+// good, and the time when it should be replaced. The next update time is
+// zero if the server didn't give one.
+func FetchOCSPResponse(leaf, issuer *x509.Certificate) ([]byte, time.Time, error) {
+	if len(leaf.OCSPServer) == 0 {
+		return nil, time.Time{}, ErrNoOCSPServer
+	}
+	if issuer == nil {
+		return nil, time.Time{}, ErrNoIssuer
+	}
+
+	reqBytes, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	httpResp, err := ocspHTTPClient.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(reqBytes))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("OCSP server: %s", httpResp.Status)
+	}
+	resp, err := ioutil.ReadAll(io.LimitReader(httpResp.Body, ocspMaxResponseSize))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	nextUpdate, err := verifyOCSPResponse(resp, leaf, issuer, time.Now())
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return resp, nextUpdate, nil
+}
+
+// verifyOCSPResponse checks that resp is a current response signed by the
+// issuer, or a responder certified by it, saying that leaf is good. It
+// returns the next update time from the response.
+func verifyOCSPResponse(resp []byte, leaf, issuer *x509.Certificate, now time.Time) (time.Time, error) {
+	parsed, err := ocsp.ParseResponseForCert(resp, leaf, issuer)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parse OCSP response: %s", err)
+	}
+
+	// A responder other than the issuer itself must be certified for the
+	// purpose; the signatures have been checked already.
+	if parsed.Certificate != nil && !bytes.Equal(parsed.Certificate.Raw, issuer.Raw) &&
+		!hasExtKeyUsage(parsed.Certificate, x509.ExtKeyUsageOCSPSigning) {
+		return time.Time{}, errors.New("OCSP responder not authorized for signing")
+	}
+
+	switch {
+	case parsed.Status == ocsp.Revoked:
+		return time.Time{}, errors.New("certificate is revoked")
+	case parsed.Status != ocsp.Good:
+		return time.Time{}, errors.New("certificate status unknown")
+	case now.Before(parsed.ThisUpdate):
+		return time.Time{}, errors.New("OCSP response not yet valid")
+	case !parsed.NextUpdate.IsZero() && now.After(parsed.NextUpdate):
+		return time.Time{}, errors.New("OCSP response expired")
+	}
+	return parsed.NextUpdate, nil
+}
@@ -0,0 +1,161 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// newOCSPTestLeaf returns a certificate issued by ca with the given OCSP
+// server.
+func newOCSPTestLeaf(t *testing.T, ca *CA, ocspServer string) tls.Certificate {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template, err := certificateTemplate(CertificateOptions{CommonName: "leaf"}, x509.ECDSAWithSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SignatureAlgorithm = x509.UnknownSignatureAlgorithm
+	if ocspServer != "" {
+		template.OCSPServer = []string{ocspServer}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, priv.Public(), ca.Signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der, ca.Cert.Raw},
+		PrivateKey:  priv,
+		Leaf:        leaf,
+	}
+}
+
+// newOCSPTestResponse returns a response about leaf, signed by ca.
+func newOCSPTestResponse(t *testing.T, ca *CA, leaf *x509.Certificate, revoked bool, nextUpdate time.Time) []byte {
+	template := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: leaf.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Hour).Truncate(time.Second),
+		NextUpdate:   nextUpdate.Truncate(time.Second),
+	}
+	if revoked {
+		template.Status = ocsp.Revoked
+		template.RevokedAt = template.ThisUpdate
+	}
+	resp, err := ocsp.CreateResponse(ca.Cert, ca.Cert, template, ca.Signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestOCSPStapling(t *testing.T) {
+	ca, err := NewCA("ca", 0, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response []byte
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if ct := r.Header.Get("Content-Type"); ct != "application/ocsp-request" {
+			t.Errorf("request with content type %q", ct)
+		}
+		bs, _ := ioutil.ReadAll(r.Body)
+		if _, err := ocsp.ParseRequest(bs); err != nil {
+			t.Errorf("parse request: %v", err)
+		}
+		w.Write(response)
+	}))
+	defer server.Close()
+
+	cert := newOCSPTestLeaf(t, ca, server.URL)
+	response = newOCSPTestResponse(t, ca, cert.Leaf, false, time.Now().Add(24*time.Hour))
+
+	stapler, err := NewOCSPStapler(cert, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stapler.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Errorf("%d requests to the OCSP server", requests)
+	}
+
+	state, err := handshakeConfigs(&tls.Config{GetCertificate: stapler.GetCertificate}, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(state.OCSPResponse, response) {
+		t.Error("stapled OCSP response not presented in handshake")
+	}
+
+	// A response saying the certificate is revoked is not stapled.
+	response = newOCSPTestResponse(t, ca, cert.Leaf, true, time.Now().Add(24*time.Hour))
+	if err := stapler.Refresh(); err == nil {
+		t.Error("revoked response should be rejected")
+	}
+
+	// Neither is an expired one.
+	response = newOCSPTestResponse(t, ca, cert.Leaf, false, time.Now().Add(-time.Minute))
+	if err := stapler.Refresh(); err == nil {
+		t.Error("expired response should be rejected")
+	}
+
+	// Nor one signed by someone else.
+	other, err := NewCA("other", 0, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response = newOCSPTestResponse(t, other, cert.Leaf, false, time.Now().Add(24*time.Hour))
+	if err := stapler.Refresh(); err == nil {
+		t.Error("response with invalid signature should be rejected")
+	}
+}
+
+func TestOCSPStaplingWithoutServer(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stapler, err := NewOCSPStapler(cert, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stapler.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := handshakeConfigs(&tls.Config{GetCertificate: stapler.GetCertificate}, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.OCSPResponse != nil {
+		t.Error("unexpected OCSP response")
+	}
+}
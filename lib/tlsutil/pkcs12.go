@@ -0,0 +1,140 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// PKCS#12 (RFC 7292) bundles are written with the modern parameters of
+// go-pkcs12: certificates and key encrypted with PBES2 and AES-256-CBC, and
+// an HMAC-SHA256 integrity check. This is what OpenSSL 3 produces by default
+// and is understood by all current TLS stacks.
+
+var oidPBMAC1 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 14}
+
+// pfxMacData is just enough of a PKCS#12 bundle to look at the cost of
+// checking its MAC, before handing it to the decoder.
+type pfxMacData struct {
+	Version  int
+	AuthSafe asn1.RawValue
+	MacData  struct {
+		Mac struct {
+			Algorithm pkix.AlgorithmIdentifier
+			Digest    []byte
+		}
+		MacSalt    []byte
+		Iterations int `asn1:"optional,default:1"`
+	} `asn1:"optional"`
+}
+
+type pbmac1Params struct {
+	KDF    pkix.AlgorithmIdentifier
+	MacAlg pkix.AlgorithmIdentifier
+}
+
+// ExportPKCS12 returns the certificate chain and private key as a password
+// protected PKCS#12 bundle, for use with other TLS stacks.
+func ExportPKCS12(cert tls.Certificate, password string) ([]byte, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, ErrNoCertificate
+	}
+	if _, ok := cert.PrivateKey.(crypto.Signer); !ok {
+		return nil, ErrNoPrivateKey
+	}
+
+	certs, err := x509.ParseCertificates(bytes.Join(cert.Certificate, nil))
+	if err != nil {
+		return nil, fmt.Errorf("parse cert: %s", err)
+	}
+	data, err := pkcs12.Modern.Encode(cert.PrivateKey, certs[0], certs[1:], password)
+	if err != nil {
+		return nil, fmt.Errorf("export pkcs12: %s", err)
+	}
+	return data, nil
+}
+
+// ImportPKCS12 returns the certificate chain and private key from a
+// password protected PKCS#12 bundle, such as those written by ExportPKCS12
+// or OpenSSL, with Leaf set. The certificate the key belongs to is returned
+// first, followed by the rest of the chain in bundle order. Bundles with a
+// MAC iteration count above a million are rejected.
+func ImportPKCS12(data []byte, password string) (tls.Certificate, error) {
+	if err := checkPKCS12Iterations(data); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	priv, leaf, chain, err := pkcs12.DecodeChain(data, password)
+	if err == pkcs12.ErrIncorrectPassword {
+		return tls.Certificate{}, ErrIncorrectPassphrase
+	} else if err != nil {
+		return tls.Certificate{}, fmt.Errorf("import pkcs12: %s", err)
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return tls.Certificate{}, ErrNoPrivateKey
+	}
+
+	// The decoder takes the first certificate to be the leaf; look for the
+	// one that actually matches the key.
+	certs := append([]*x509.Certificate{leaf}, chain...)
+	leafIdx := -1
+	for i, c := range certs {
+		if pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); ok && pub.Equal(c.PublicKey) {
+			leafIdx = i
+			break
+		}
+	}
+	if leafIdx < 0 {
+		return tls.Certificate{}, errors.New("import pkcs12: private key does not match any certificate")
+	}
+
+	cert := tls.Certificate{PrivateKey: priv, Leaf: certs[leafIdx]}
+	cert.Certificate = append(cert.Certificate, certs[leafIdx].Raw)
+	for i, c := range certs {
+		if i != leafIdx {
+			cert.Certificate = append(cert.Certificate, c.Raw)
+		}
+	}
+	return cert, nil
+}
+
+// checkPKCS12Iterations rejects bundles whose MAC would take unreasonably
+// long to verify, which the decoder doesn't limit.
+func checkPKCS12Iterations(data []byte) error {
+	var pfx pfxMacData
+	if _, err := asn1.Unmarshal(data, &pfx); err != nil {
+		return fmt.Errorf("import pkcs12: %s", err)
+	}
+
+	iterations := pfx.MacData.Iterations
+	if pfx.MacData.Mac.Algorithm.Algorithm.Equal(oidPBMAC1) {
+		// PBMAC1 keeps its iteration count in the PBKDF2 parameters.
+		var params pbmac1Params
+		if _, err := asn1.Unmarshal(pfx.MacData.Mac.Algorithm.Parameters.FullBytes, &params); err != nil {
+			return fmt.Errorf("import pkcs12: %s", err)
+		}
+		var kdf pbkdf2Params
+		if _, err := asn1.Unmarshal(params.KDF.Parameters.FullBytes, &kdf); err != nil {
+			return fmt.Errorf("import pkcs12: %s", err)
+		}
+		iterations = kdf.IterationCount
+	}
+	if iterations > maxKDFIterations {
+		return fmt.Errorf("import pkcs12: unreasonable MAC iteration count %d", iterations)
+	}
+	return nil
+}
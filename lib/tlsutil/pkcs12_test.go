@@ -0,0 +1,145 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"reflect"
+	"testing"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestExportPKCS12(t *testing.T) {
+	fixture, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test := TestCertificate()
+	chain := tls.Certificate{
+		Certificate: [][]byte{test.Certificate[0], fixture.Certificate[0]},
+		PrivateKey:  test.PrivateKey,
+	}
+
+	for _, cert := range []tls.Certificate{fixture, chain} {
+		data, err := ExportPKCS12(cert, "s3cret")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		priv, leaf, chain, err := pkcs12.DecodeChain(data, "s3cret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := [][]byte{leaf.Raw}
+		for _, c := range chain {
+			got = append(got, c.Raw)
+		}
+		if !reflect.DeepEqual(got, cert.Certificate) {
+			t.Error("certificate chain differs")
+		}
+		if !reflect.DeepEqual(priv, cert.PrivateKey) {
+			t.Error("private key differs")
+		}
+	}
+
+	if _, err := ExportPKCS12(tls.Certificate{}, "s3cret"); err != ErrNoCertificate {
+		t.Errorf("got %v, expected ErrNoCertificate", err)
+	}
+}
+
+func TestImportPKCS12(t *testing.T) {
+	fixture, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test := TestCertificate()
+	chain := tls.Certificate{
+		Certificate: [][]byte{test.Certificate[0], fixture.Certificate[0]},
+		PrivateKey:  test.PrivateKey,
+	}
+
+	data, err := ExportPKCS12(chain, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := ImportPKCS12(data, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cert.Certificate, chain.Certificate) {
+		t.Error("certificate chain differs")
+	}
+	if cert.Leaf == nil || !bytes.Equal(cert.Leaf.Raw, chain.Certificate[0]) {
+		t.Error("leaf should be set to the first certificate")
+	}
+	if !reflect.DeepEqual(cert.PrivateKey, chain.PrivateKey) {
+		t.Error("private key differs")
+	}
+
+	if _, err := ImportPKCS12(data, "wrong"); err != ErrIncorrectPassphrase {
+		t.Errorf("got %v, expected ErrIncorrectPassphrase", err)
+	}
+	if _, err := ImportPKCS12(data[:len(data)/2], "s3cret"); err == nil {
+		t.Error("unexpected nil error for truncated data")
+	}
+
+	// A bundle listing the key's certificate after another one still
+	// gets it as the leaf.
+	reordered, err := pkcs12.Modern.Encode(test.PrivateKey, fixture.Leaf, []*x509.Certificate{test.Leaf}, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = ImportPKCS12(reordered, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cert.Certificate, chain.Certificate) {
+		t.Error("the key's certificate should come first")
+	}
+}
+
+func TestImportPKCS12PBMAC1(t *testing.T) {
+	cert := TestCertificate()
+	data, err := pkcs12.Modern2026.Encode(cert.PrivateKey, cert.Leaf, nil, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportPKCS12(data, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(imported.Certificate, cert.Certificate) {
+		t.Error("certificate differs")
+	}
+}
+
+func TestImportPKCS12Iterations(t *testing.T) {
+	data, err := ExportPKCS12(TestCertificate(), "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A bundle that would take forever to check is rejected outright,
+	// rather than ending up as an incorrect password.
+	var pfx pfxMacData
+	if _, err := asn1.Unmarshal(data, &pfx); err != nil {
+		t.Fatal(err)
+	}
+	pfx.MacData.Iterations = maxKDFIterations + 1
+	data, err = asn1.Marshal(pfx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportPKCS12(data, "s3cret"); err == nil || err == ErrIncorrectPassphrase {
+		t.Errorf("got %v, expected the iteration count to be refused", err)
+	}
+}
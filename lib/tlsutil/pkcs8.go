@@ -0,0 +1,202 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// Encrypted private keys are stored as PKCS#8 EncryptedPrivateKeyInfo
+// (RFC 5958) using PBES2 (RFC 8018) with PBKDF2-HMAC-SHA256 and AES-256-CBC.
+// This is what "openssl pkcs8 -topk8 -v2 aes256" produces and avoids the
+// weak, deprecated legacy PEM encryption.
+
+var ErrIncorrectPassphrase = errors.New("incorrect passphrase")
+
+const (
+	pbkdf2Iterations = 100000
+	pbkdf2SaltSize   = 16
+	aes256KeySize    = 32
+)
+
+// maxKDFIterations limits the iteration counts accepted from encrypted
+// files, which would otherwise let a crafted file use the CPU for as long as
+// it likes.
+const maxKDFIterations = 1 << 20
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// encryptPKCS8 encrypts the given PKCS#8 encoded private key with the
+// passphrase and returns it as an "ENCRYPTED PRIVATE KEY" PEM block.
+func encryptPKCS8(der []byte, passphrase string) (*pem.Block, error) {
+	salt := make([]byte, pbkdf2SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, pbkdf2Iterations, aes256KeySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// PKCS#7 padding; there is always at least one byte of padding.
+	pad := aes.BlockSize - len(der)%aes.BlockSize
+	data := make([]byte, len(der), len(der)+pad)
+	copy(data, der)
+	data = append(data, bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: pbkdf2Iterations,
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	encParams, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: encParams}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bs, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: data,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: bs}, nil
+}
+
+// decryptPKCS8 decrypts an "ENCRYPTED PRIVATE KEY" PEM block as written by
+// encryptPKCS8 and returns the PKCS#8 encoded private key.
+func decryptPKCS8(block *pem.Block, passphrase string) ([]byte, error) {
+	if block.Type != "ENCRYPTED PRIVATE KEY" {
+		return nil, fmt.Errorf("unexpected key type %q", block.Type)
+	}
+
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(block.Bytes, &info); err != nil {
+		return nil, fmt.Errorf("parse encrypted key: %s", err)
+	}
+	return decryptPBES2(info.Algorithm, info.EncryptedData, passphrase)
+}
+
+// decryptPBES2 decrypts data encrypted with the given PBES2 algorithm, as
+// written by encryptPKCS8.
+func decryptPBES2(alg pkix.AlgorithmIdentifier, data []byte, passphrase string) ([]byte, error) {
+	if !alg.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported key encryption %v", alg.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("parse encrypted key: %s", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation %v", params.KeyDerivationFunc.Algorithm)
+	}
+	if !params.EncryptionScheme.Algorithm.Equal(oidAES256CBC) {
+		return nil, fmt.Errorf("unsupported key cipher %v", params.EncryptionScheme.Algorithm)
+	}
+
+	var kdfParams pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams); err != nil {
+		return nil, fmt.Errorf("parse encrypted key: %s", err)
+	}
+	if !kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA256) {
+		return nil, fmt.Errorf("unsupported key derivation hash %v", kdfParams.PRF.Algorithm)
+	}
+	if kdfParams.IterationCount < 1 || kdfParams.IterationCount > maxKDFIterations {
+		return nil, fmt.Errorf("parse encrypted key: unreasonable iteration count %d", kdfParams.IterationCount)
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, fmt.Errorf("parse encrypted key: %s", err)
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("parse encrypted key: incorrect IV length")
+	}
+
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("parse encrypted key: incorrect data length")
+	}
+
+	key, err := pbkdf2.Key(sha256.New, passphrase, kdfParams.Salt, kdfParams.IterationCount, aes256KeySize)
+	if err != nil {
+		return nil, err
+	}
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	der := make([]byte, len(data))
+	cipher.NewCBCDecrypter(c, iv).CryptBlocks(der, data)
+
+	// A wrong passphrase almost always results in invalid padding.
+	pad := int(der[len(der)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, ErrIncorrectPassphrase
+	}
+	for _, b := range der[len(der)-pad:] {
+		if int(b) != pad {
+			return nil, ErrIncorrectPassphrase
+		}
+	}
+
+	return der[:len(der)-pad], nil
+}
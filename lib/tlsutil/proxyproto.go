@@ -0,0 +1,159 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ProxyProtocolMode selects whether DowngradingListener expects connections
+// to start with a PROXY protocol header, as sent by HAProxy and similar load
+// balancers.
+type ProxyProtocolMode int
+
+const (
+	// ProxyProtocolOff treats a PROXY header like any other data.
+	ProxyProtocolOff ProxyProtocolMode = iota
+	// ProxyProtocolOptional consumes a PROXY header if there is one. As
+	// the header isn't authenticated, any client that can reach the
+	// listener directly can send one and set its RemoteAddr to whatever
+	// it likes. Only use it where all connections come through a trusted
+	// proxy, or where the remote address is informational only.
+	ProxyProtocolOptional
+	// ProxyProtocolRequired drops connections without a PROXY header.
+	ProxyProtocolRequired
+)
+
+var ErrNoProxyHeader = errors.New("no PROXY protocol header")
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// The longest possible v1 header, including the CRLF.
+const proxyV1MaxLength = 107
+
+// readProxyHeader consumes a PROXY protocol header of either version from
+// br and returns the source address it contains. The address is nil if the
+// header doesn't carry one, or if there is no header and it isn't required.
+func readProxyHeader(br *bufio.Reader, required bool) (net.Addr, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		if bs, err := br.Peek(len(proxyV1Prefix)); err == nil && bytes.Equal(bs, proxyV1Prefix) {
+			return readProxyV1(br)
+		}
+	case proxyV2Signature[0]:
+		if bs, err := br.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(bs, proxyV2Signature) {
+			return readProxyV2(br)
+		}
+	}
+
+	if required {
+		return nil, ErrNoProxyHeader
+	}
+	return nil, nil
+}
+
+// readProxyV1 parses a header like "PROXY TCP4 192.0.2.1 192.0.2.2 56324
+// 443\r\n".
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+	line, err := br.ReadSlice('\n')
+	if err != nil && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	if len(line) > proxyV1MaxLength || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY v1 header too long")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	switch {
+	case ip == nil,
+		fields[1] == "TCP4" && ip.To4() == nil,
+		fields[1] == "TCP6" && ip.To4() != nil,
+		fields[1] != "TCP4" && fields[1] != "TCP6":
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses a binary header.
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY header version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+
+	const (
+		cmdLocal = 0x0
+		cmdProxy = 0x1
+		afInet   = 0x1
+		afInet6  = 0x2
+	)
+
+	switch hdr[12] & 0xf {
+	case cmdLocal:
+		// A health check from the proxy itself.
+		return nil, nil
+	case cmdProxy:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command %d", hdr[12]&0xf)
+	}
+
+	switch hdr[13] >> 4 {
+	case afInet:
+		if len(body) < 12 {
+			return nil, errors.New("short PROXY v2 address block")
+		}
+		ip := net.IP(append([]byte(nil), body[:4]...))
+		return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case afInet6:
+		if len(body) < 36 {
+			return nil, errors.New("short PROXY v2 address block")
+		}
+		ip := net.IP(append([]byte(nil), body[:16]...))
+		return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	default:
+		// Unix sockets and unspecified families don't give us anything
+		// useful.
+		return nil, nil
+	}
+}
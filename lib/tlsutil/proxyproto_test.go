@@ -0,0 +1,153 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+var proxyHeaderCases = []struct {
+	name   string
+	header string
+	addr   string
+}{
+	{"v1 TCP4", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 22000\r\n", "192.0.2.1:56324"},
+	{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 22000\r\n", "[2001:db8::1]:56324"},
+	{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "pipe"},
+	{"v2 IPv4", "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c" +
+		"\xc0\x00\x02\x01" + "\xc0\x00\x02\x02" + "\xdb\xc4" + "\x55\xf0", "192.0.2.1:56260"},
+	{"v2 IPv6", "\r\n\r\n\x00\r\nQUIT\n\x21\x21\x00\x24" +
+		"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+		"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+		"\xdb\xc4" + "\x55\xf0", "[2001:db8::1]:56260"},
+	{"v2 LOCAL", "\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00", "pipe"},
+	{"absent", "", "pipe"},
+}
+
+func TestProxyProtocolHeader(t *testing.T) {
+	// The headers must be read with a buffer smaller than the longest
+	// v1 header, too.
+	for _, bufferSize := range []int{0, 16} {
+		testProxyProtocolHeader(t, bufferSize)
+	}
+}
+
+func testProxyProtocolHeader(t *testing.T, bufferSize int) {
+	const payload = "GET / HTTP/1.1\r\n\r\n"
+
+	for _, tc := range proxyHeaderCases {
+		server, client := net.Pipe()
+		l := &DowngradingListener{
+			Listener:      newFakeListener(server),
+			PeekTimeout:   100 * time.Millisecond,
+			ProxyProtocol: ProxyProtocolOptional,
+			BufferSize:    bufferSize,
+		}
+
+		go func() {
+			client.Write([]byte(tc.header + payload))
+			client.Close()
+		}()
+
+		conn, proto, err := l.AcceptWithProtocol()
+		if err != nil {
+			t.Fatalf("%s, buffer size %d: %v", tc.name, bufferSize, err)
+		}
+		if proto != ProtocolHTTP {
+			t.Errorf("%s, buffer size %d: incorrect protocol %v", tc.name, bufferSize, proto)
+		}
+		if addr := conn.RemoteAddr().String(); addr != tc.addr {
+			t.Errorf("%s, buffer size %d: remote address %s, expected %s", tc.name, bufferSize, addr, tc.addr)
+		}
+
+		// The header must be consumed, leaving only the payload.
+		bs, err := ioutil.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(bs) != payload {
+			t.Errorf("%s, buffer size %d: read %q, expected %q", tc.name, bufferSize, bs, payload)
+		}
+		conn.Close()
+	}
+}
+
+func TestProxyProtocolRequired(t *testing.T) {
+	const header = "PROXY TCP4 192.0.2.1 192.0.2.2 56324 22000\r\n"
+
+	bad := []string{
+		// No header at all
+		"GET / HTTP/1.1\r\n\r\n",
+		// Malformed headers
+		"PROXY TCP4 192.0.2.1\r\n",
+		"PROXY TCP4 2001:db8::1 2001:db8::2 56324 22000\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 99999 22000\r\n",
+	}
+
+	var conns []net.Conn
+	for _, data := range append(bad, header+"GET / HTTP/1.1\r\n\r\n") {
+		server, client := net.Pipe()
+		conns = append(conns, server)
+		go func(data string) {
+			client.Write([]byte(data))
+			client.Close()
+		}(data)
+	}
+
+	l := &DowngradingListener{
+		Listener:      newFakeListener(conns...),
+		PeekTimeout:   100 * time.Millisecond,
+		ProxyProtocol: ProxyProtocolRequired,
+	}
+
+	// Only the connection with a valid header is returned.
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := conn.RemoteAddr().String(); addr != "192.0.2.1:56324" {
+		t.Errorf("remote address %s, expected 192.0.2.1:56324", addr)
+	}
+	conn.Close()
+
+	if n := l.FailedCount(); n != int64(len(bad)) {
+		t.Errorf("%d failed connections, expected %d", n, len(bad))
+	}
+}
+
+func TestProxyProtocolOff(t *testing.T) {
+	const data = "PROXY TCP4 192.0.2.1 192.0.2.2 56324 22000\r\n"
+
+	server, client := net.Pipe()
+	l := &DowngradingListener{
+		Listener:    newFakeListener(server),
+		PeekTimeout: 100 * time.Millisecond,
+	}
+
+	go func() {
+		client.Write([]byte(data))
+		client.Close()
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := conn.RemoteAddr().String(); addr != "pipe" {
+		t.Errorf("remote address %s should not be taken from the header", addr)
+	}
+	bs, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != data {
+		t.Errorf("read %q, expected %q", bs, data)
+	}
+}
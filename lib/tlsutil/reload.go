@@ -0,0 +1,186 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// A Logger receives messages about background events, like certificate
+// reloads. The loggers from lib/logger fulfil it.
+type Logger interface {
+	Infof(format string, vals ...interface{})
+	Warnf(format string, vals ...interface{})
+}
+
+// nopLogger discards all messages; it stands in where no Logger is set.
+type nopLogger struct{}
+
+func (nopLogger) Infof(format string, vals ...interface{}) {}
+func (nopLogger) Warnf(format string, vals ...interface{}) {}
+
+// loggerOrNop returns l, or a Logger discarding all messages if l is nil.
+func loggerOrNop(l Logger) Logger {
+	if l == nil {
+		return nopLogger{}
+	}
+	return l
+}
+
+var (
+	// How often Watch looks at the files.
+	certWatchInterval = 1 * time.Second
+	// How many times in a row Watch tries to load changed files before
+	// giving up until they change again.
+	certWatchRetries = 5
+)
+
+// A CertReloader serves a certificate loaded from disk, and loads it again
+// on Reload. Use its GetCertificate method in tls.Config so that new
+// connections use the current certificate.
+type CertReloader struct {
+	// Logger, if set, receives warnings about failed reloads and weak keys,
+	// and is the default for Watch. Set it before calling any methods.
+	Logger Logger
+
+	certFile string
+	keyFile  string
+	onError  func(error)
+
+	mut  sync.Mutex
+	cert *tls.Certificate
+	// loaded is the stamp of the files when cert was loaded.
+	loaded string
+}
+
+// NewCertReloader loads the certificate and key from the given files. The
+// onError function, if not nil, is called with the error when a later
+// Reload fails.
+func NewCertReloader(certFile, keyFile string, onError func(error)) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		onError:  onError,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate and key again. If they can't be loaded, or
+// don't match, the previous certificate stays in use.
+func (r *CertReloader) Reload() error {
+	err := r.load()
+	if err != nil {
+		loggerOrNop(r.Logger).Warnf("Reloading certificate %s: %v", r.certFile, err)
+		if r.onError != nil {
+			r.onError(err)
+		}
+	}
+	return err
+}
+
+func (r *CertReloader) load() error {
+	stamp := r.stamp()
+	cert, err := withLeaf(tls.LoadX509KeyPair(r.certFile, r.keyFile))
+	if err != nil {
+		return err
+	}
+	if priv, ok := cert.PrivateKey.(*rsa.PrivateKey); ok && priv.N.BitLen() < MinRSABits {
+		loggerOrNop(r.Logger).Warnf("Certificate %s has a weak %d bit RSA key; regenerate it with at least %d bits", r.certFile, priv.N.BitLen(), MinRSABits)
+	}
+
+	r.mut.Lock()
+	r.cert = &cert
+	r.loaded = stamp
+	r.mut.Unlock()
+	return nil
+}
+
+// Watch reloads the certificate when the files change, until ctx is
+// cancelled. A change is acted on once the files have been left alone for a
+// moment, and loading is retried for a while if it fails, since the two
+// files are rarely rewritten at exactly the same time. The logger may be
+// nil, in which case the reloader's Logger is used.
+func (r *CertReloader) Watch(ctx context.Context, logger Logger) {
+	if logger == nil {
+		logger = loggerOrNop(r.Logger)
+	}
+	ticker := time.NewTicker(certWatchInterval)
+	defer ticker.Stop()
+
+	var pending string
+	failures := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		r.mut.Lock()
+		loaded := r.loaded
+		r.mut.Unlock()
+
+		cur := r.stamp()
+		if cur == loaded {
+			continue
+		}
+		if cur != pending {
+			// Still changing; wait for it to settle.
+			pending = cur
+			failures = 0
+			continue
+		}
+
+		if err := r.load(); err != nil {
+			failures++
+			if failures < certWatchRetries {
+				continue
+			}
+			logger.Warnf("Reloading certificate %s: %v", r.certFile, err)
+			if r.onError != nil {
+				r.onError(err)
+			}
+			// Give up until the files change again.
+			r.mut.Lock()
+			r.loaded = cur
+			r.mut.Unlock()
+		} else {
+			logger.Infof("Reloaded certificate %s", r.certFile)
+		}
+		failures = 0
+	}
+}
+
+// stamp returns a string that changes when either of the files changes.
+func (r *CertReloader) stamp() string {
+	var stamp string
+	for _, path := range []string{r.certFile, r.keyFile} {
+		if info, err := os.Stat(path); err == nil {
+			stamp += fmt.Sprintf("%d:%d;", info.ModTime().UnixNano(), info.Size())
+		} else {
+			stamp += "-;"
+		}
+	}
+	return stamp
+}
+
+// GetCertificate returns the current certificate. It can be used as
+// tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.cert, nil
+}
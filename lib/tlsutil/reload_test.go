@@ -0,0 +1,236 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"context"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// peerCommonName returns the common name of the certificate presented by a
+// server with the given configuration.
+func peerCommonName(t *testing.T, serverCfg *tls.Config) string {
+	state, err := handshakeConfigs(serverCfg, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if _, err := NewCertificateECDSA(certFile, keyFile, "first", elliptic.P256()); err != nil {
+		t.Fatal(err)
+	}
+
+	var errs []error
+	r, err := NewCertReloader(certFile, keyFile, func(err error) {
+		errs = append(errs, err)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &tls.Config{GetCertificate: r.GetCertificate}
+
+	if cn := peerCommonName(t, cfg); cn != "first" {
+		t.Errorf("got certificate %q, expected first", cn)
+	}
+
+	// Replace the certificate.
+	if _, err := NewCertificateECDSA(certFile, keyFile, "second", elliptic.P256()); err != nil {
+		t.Fatal(err)
+	}
+	if cn := peerCommonName(t, cfg); cn != "first" {
+		t.Errorf("got certificate %q before reload, expected first", cn)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if cn := peerCommonName(t, cfg); cn != "second" {
+		t.Errorf("got certificate %q, expected second", cn)
+	}
+
+	// A broken certificate isn't loaded.
+	if err := ioutil.WriteFile(certFile, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Error("broken certificate should not be loaded")
+	}
+	if len(errs) != 1 {
+		t.Errorf("error callback called %d times, expected once", len(errs))
+	}
+	if cn := peerCommonName(t, cfg); cn != "second" {
+		t.Errorf("got certificate %q, expected second", cn)
+	}
+}
+
+func TestCertReloaderLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if _, err := NewCertificateECDSA(certFile, keyFile, "syncthing", elliptic.P256()); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewCertReloader(certFile, keyFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := new(testLogger)
+	r.Logger = logger
+
+	// A failed reload is logged.
+	if err := ioutil.WriteFile(certFile, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Fatal("broken certificate should not be loaded")
+	}
+
+	// So is loading a weak key, which is still used.
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weak, err := newKeyPair(CertificateOptions{CommonName: "weak"}, x509.SHA256WithRSA, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, _ := CertificatePEM(weak)
+	keyPEM, _ := PrivateKeyPEM(weak)
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(logger.msgs) != 2 ||
+		!strings.HasPrefix(logger.msgs[0], "WARNING: Reloading certificate") ||
+		!strings.HasPrefix(logger.msgs[1], "WARNING: Certificate "+certFile+" has a weak 1024 bit RSA key") {
+		t.Errorf("unexpected log messages %q", logger.msgs)
+	}
+}
+
+// A testLogger records the messages logged to it.
+type testLogger struct {
+	mut  sync.Mutex
+	msgs []string
+}
+
+func (l *testLogger) Infof(format string, vals ...interface{}) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	l.msgs = append(l.msgs, "INFO: "+fmt.Sprintf(format, vals...))
+}
+
+func (l *testLogger) Warnf(format string, vals ...interface{}) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	l.msgs = append(l.msgs, "WARNING: "+fmt.Sprintf(format, vals...))
+}
+
+// waitForCommonName waits for r to serve a certificate with the given
+// common name.
+func waitForCommonName(r *CertReloader, commonName string) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		cert, _ := r.GetCertificate(nil)
+		if cert.Leaf.Subject.CommonName == commonName {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestCertReloaderWatch(t *testing.T) {
+	oldInterval := certWatchInterval
+	certWatchInterval = 10 * time.Millisecond
+	defer func() {
+		certWatchInterval = oldInterval
+	}()
+
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if _, err := NewCertificateECDSA(certFile, keyFile, "first", elliptic.P256()); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewCertReloader(certFile, keyFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := &testLogger{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, logger)
+
+	// Both files rewritten at once.
+	if _, err := NewCertificateECDSA(certFile, keyFile, "second", elliptic.P256()); err != nil {
+		t.Fatal(err)
+	}
+	if !waitForCommonName(r, "second") {
+		t.Fatal("certificate not reloaded")
+	}
+
+	// One file at a time, with a delay in between.
+	newCert := filepath.Join(dir, "new-cert.pem")
+	newKey := filepath.Join(dir, "new-key.pem")
+	if _, err := NewCertificateECDSA(newCert, newKey, "third", elliptic.P256()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(newCert, certFile); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if err := os.Rename(newKey, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if !waitForCommonName(r, "third") {
+		t.Fatal("certificate not reloaded")
+	}
+
+	logger.mut.Lock()
+	defer logger.mut.Unlock()
+	if len(logger.msgs) == 0 || !strings.HasPrefix(logger.msgs[len(logger.msgs)-1], "INFO: Reloaded") {
+		t.Errorf("unexpected log messages %q", logger.msgs)
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package tlsutil
+
+const reusePortSupported = false
+
+// setReuseOptions does nothing here. On Windows in particular SO_REUSEADDR
+// would let other sockets take over the port, rather than share it.
+func setReuseOptions(fd uintptr) error {
+	return nil
+}
@@ -0,0 +1,13 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build darwin dragonfly freebsd netbsd openbsd linux,!386,!amd64,!arm
+
+package tlsutil
+
+import "syscall"
+
+const soReusePort = syscall.SO_REUSEPORT
@@ -0,0 +1,29 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package tlsutil
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const reusePortSupported = true
+
+func setReuseOptions(fd uintptr) error {
+	if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return fmt.Errorf("set SO_REUSEADDR: %s", err)
+	}
+	// Kernels that predate SO_REUSEPORT, like Linux before 3.9, reject it.
+	// The listener then works as if it hadn't been requested.
+	err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	if err != nil && err != syscall.ENOPROTOOPT && err != syscall.EINVAL {
+		return fmt.Errorf("set SO_REUSEPORT: %s", err)
+	}
+	return nil
+}
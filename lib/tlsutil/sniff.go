@@ -0,0 +1,279 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// A Protocol is the type of a connection as detected by DowngradingListener
+// from the first bytes sent by the client.
+type Protocol int
+
+const (
+	ProtocolUnknown Protocol = iota
+	ProtocolTLS
+	ProtocolHTTP
+	ProtocolSOCKS5
+	ProtocolBEP
+	ProtocolHTTP2
+	ProtocolWebSocket
+	ProtocolHTTPConnect
+)
+
+// ProtocolCustom is the first Protocol value free for use by custom
+// matchers.
+const ProtocolCustom Protocol = 1000
+
+// A MatchFunc identifies a protocol from the first bytes of a connection,
+// or returns ProtocolUnknown. It's called with the data received so far,
+// which may be shorter than the peek length.
+type MatchFunc func(prefix []byte) Protocol
+
+// Match makes a MatchFunc a Matcher, matching whenever the function returns
+// something other than ProtocolUnknown.
+func (f MatchFunc) Match(prefix []byte) (Protocol, bool) {
+	proto := f(prefix)
+	return proto, proto != ProtocolUnknown
+}
+
+// PeekLength is zero for a MatchFunc, which gets whatever the listener's
+// peek length allows.
+func (f MatchFunc) PeekLength() int {
+	return 0
+}
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolUnknown:
+		return "unknown"
+	case ProtocolTLS:
+		return "TLS"
+	case ProtocolHTTP:
+		return "HTTP"
+	case ProtocolSOCKS5:
+		return "SOCKS5"
+	case ProtocolBEP:
+		return "BEP"
+	case ProtocolHTTP2:
+		return "HTTP/2"
+	case ProtocolWebSocket:
+		return "WebSocket"
+	case ProtocolHTTPConnect:
+		return "HTTP CONNECT"
+	default:
+		return fmt.Sprintf("Protocol(%d)", int(p))
+	}
+}
+
+// sniffLength is the number of bytes needed to identify any of the built in
+// protocols; it's the length of the HTTP/2 preface.
+const sniffLength = len(http2Preface)
+
+// http2Preface is sent first by HTTP/2 clients with prior knowledge, that
+// is without upgrading from HTTP/1.1 (RFC 7540 section 3.5).
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// bepMagic starts the Hello message of the Block Exchange Protocol, sent
+// first on a BEP connection.
+var bepMagic = []byte{0x2e, 0xa7, 0xd9, 0x0b}
+
+var httpMethods = [][]byte{
+	[]byte("GET "),
+	[]byte("HEAD "),
+	[]byte("POST "),
+	[]byte("PUT "),
+	[]byte("DELETE "),
+	[]byte("OPTIONS "),
+	[]byte("PATCH "),
+	[]byte("TRACE "),
+}
+
+// httpConnect starts an HTTP CONNECT request, as sent to a proxy to open a
+// tunnel. It's identified separately from other HTTP requests so that
+// proxy attempts can be handled differently.
+const httpConnect = "CONNECT "
+
+// A Matcher identifies a protocol from the first bytes of a connection.
+// Match is called with the data received so far, which may be shorter than
+// the peek length, and returns false if it doesn't recognize it (yet). A
+// matcher that recognizes the start of its protocol but needs more data to
+// decide returns ProtocolUnknown and true, which stops the matchers after it
+// from being tried until more data arrives. PeekLength is the number of
+// bytes the matcher needs to decide.
+type Matcher interface {
+	Match(prefix []byte) (Protocol, bool)
+	PeekLength() int
+}
+
+// A MatcherSet is a Matcher trying each of its matchers in order; the first
+// match decides. Its peek length is the largest of its matchers.
+type MatcherSet []Matcher
+
+func (s MatcherSet) Match(prefix []byte) (Protocol, bool) {
+	for _, m := range s {
+		if proto, ok := m.Match(prefix); ok {
+			return proto, true
+		}
+	}
+	return ProtocolUnknown, false
+}
+
+func (s MatcherSet) PeekLength() int {
+	n := 0
+	for _, m := range s {
+		if l := m.PeekLength(); l > n {
+			n = l
+		}
+	}
+	return n
+}
+
+// The built in matchers, as used by DowngradingListener by default.
+var (
+	TLSMatcher     Matcher = tlsMatcher{}
+	SOCKS5Matcher  Matcher = socks5Matcher{}
+	BEPMatcher     Matcher = prefixMatcher{ProtocolBEP, bepMagic}
+	HTTP2Matcher   Matcher = prefixMatcher{ProtocolHTTP2, []byte(http2Preface)}
+	ConnectMatcher Matcher = prefixMatcher{ProtocolHTTPConnect, []byte(httpConnect)}
+	HTTPMatcher    Matcher = httpMatcher{}
+)
+
+// WebSocketMatcher identifies WebSocket handshakes (RFC 6455): GET requests
+// with an "Upgrade: websocket" header. Other GET requests are identified as
+// HTTP once the request headers are complete, or have filled the peek
+// length. It's not among the DefaultMatchers, as it makes the listener wait
+// for the complete headers of every GET request; add it in front of them to
+// use it. A request that stalls before the end of its headers is identified
+// as ProtocolUnknown after the peek timeout.
+var WebSocketMatcher Matcher = webSocketMatcher{}
+
+// DefaultMatchers returns a new MatcherSet with the built in matchers, to
+// which custom matchers can be added. Matchers added at the end are tried
+// only when none of the built in ones match.
+func DefaultMatchers() MatcherSet {
+	return MatcherSet{TLSMatcher, SOCKS5Matcher, BEPMatcher, HTTP2Matcher, ConnectMatcher, HTTPMatcher}
+}
+
+var defaultMatchers = DefaultMatchers()
+
+// identify returns the protocol of a connection starting with the given
+// bytes, using the built in matchers.
+func identify(prefix []byte) Protocol {
+	proto, _ := defaultMatchers.Match(prefix)
+	return proto
+}
+
+type tlsMatcher struct{}
+
+func (tlsMatcher) Match(prefix []byte) (Protocol, bool) {
+	return ProtocolTLS, isTLSRecord(prefix)
+}
+
+func (tlsMatcher) PeekLength() int {
+	return 3
+}
+
+// A SOCKS5 greeting: the version byte followed by a non-zero number of
+// authentication methods.
+type socks5Matcher struct{}
+
+func (socks5Matcher) Match(prefix []byte) (Protocol, bool) {
+	return ProtocolSOCKS5, len(prefix) >= 2 && prefix[0] == 0x05 && prefix[1] > 0
+}
+
+func (socks5Matcher) PeekLength() int {
+	return 2
+}
+
+// A prefixMatcher matches connections starting with a fixed byte sequence.
+// The complete sequence is required; there's no reason to guess on a
+// partial match.
+type prefixMatcher struct {
+	proto  Protocol
+	prefix []byte
+}
+
+func (m prefixMatcher) Match(prefix []byte) (Protocol, bool) {
+	return m.proto, bytes.HasPrefix(prefix, m.prefix)
+}
+
+func (m prefixMatcher) PeekLength() int {
+	return len(m.prefix)
+}
+
+const webSocketPeekLength = 2048
+
+type webSocketMatcher struct{}
+
+func (webSocketMatcher) Match(prefix []byte) (Protocol, bool) {
+	if !bytes.HasPrefix(prefix, []byte("GET ")) {
+		return ProtocolUnknown, false
+	}
+	end := bytes.Index(prefix, []byte("\r\n\r\n"))
+	if end < 0 {
+		if len(prefix) < webSocketPeekLength {
+			return ProtocolUnknown, true
+		}
+		end = len(prefix)
+	}
+
+	// Skip the request line and look for the header among the rest.
+	lines := bytes.Split(prefix[:end], []byte("\r\n"))
+	for _, line := range lines[1:] {
+		i := bytes.IndexByte(line, ':')
+		if i < 0 || !bytes.EqualFold(bytes.TrimSpace(line[:i]), []byte("Upgrade")) {
+			continue
+		}
+		for _, value := range bytes.Split(line[i+1:], []byte(",")) {
+			if bytes.EqualFold(bytes.TrimSpace(value), []byte("websocket")) {
+				return ProtocolWebSocket, true
+			}
+		}
+	}
+	return ProtocolHTTP, true
+}
+
+func (webSocketMatcher) PeekLength() int {
+	return webSocketPeekLength
+}
+
+type httpMatcher struct{}
+
+func (httpMatcher) Match(prefix []byte) (Protocol, bool) {
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(prefix, method) {
+			return ProtocolHTTP, true
+		}
+	}
+	return ProtocolUnknown, false
+}
+
+func (httpMatcher) PeekLength() int {
+	n := 0
+	for _, method := range httpMethods {
+		if len(method) > n {
+			n = len(method)
+		}
+	}
+	return n
+}
+
+// isTLSRecord returns true if prefix starts with a TLS record header: a
+// content type of ChangeCipherSpec (0x14), Alert (0x15), Handshake (0x16) or
+// Application Data (0x17), followed by a protocol version between SSL 3.0
+// (3.0) and TLS 1.3 (3.4).
+func isTLSRecord(prefix []byte) bool {
+	if len(prefix) < 3 {
+		return false
+	}
+	if prefix[0] < 0x14 || prefix[0] > 0x17 {
+		return false
+	}
+	return prefix[1] == 0x03 && prefix[2] <= 0x04
+}
@@ -0,0 +1,1360 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var identifyCases = []struct {
+	data  string
+	proto Protocol
+}{
+	{"\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03", ProtocolTLS},
+	{"\x15\x03\x03\x00\x02\x02\x28", ProtocolTLS},
+	{"\x14\x03\x03\x00\x01\x01", ProtocolTLS},
+	{"\x17\x03\x03\x00\x20\x5e\x3a\x91", ProtocolTLS},
+	{"\x16\x31\xc4\x09\x7f\x00\xe2\x56", ProtocolUnknown},
+	{"\x16\x03\x05\x00\x10\x01\x00\x00", ProtocolUnknown},
+	{"\x18\x03\x01\x00\x10\x01\x00\x00", ProtocolUnknown},
+	{"\x16\x03", ProtocolUnknown},
+	{"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", ProtocolHTTP},
+	{"POST /rest/system/config HTTP/1.1\r\n", ProtocolHTTP},
+	{"HEAD / HTTP/1.0\r\n\r\n", ProtocolHTTP},
+	{"OPTIONS * HTTP/1.1\r\n", ProtocolHTTP},
+	{"GETTING STARTED", ProtocolUnknown},
+	{"CONNECT example.com:443 HTTP/1.1\r\n\r\n", ProtocolHTTPConnect},
+	{"CONNECT", ProtocolUnknown},
+	{"CONNECTED", ProtocolUnknown},
+	{"connect example.com:443 HTTP/1.1\r\n", ProtocolUnknown},
+	{"\x00\x01\x02\x03\x04\x05\x06\x07\x08", ProtocolUnknown},
+	{"\x05\x01\x00", ProtocolSOCKS5},
+	{"\x05\x02\x00\x02", ProtocolSOCKS5},
+	{"\x05\x00\x00\x00\x00\x00\x00\x00", ProtocolUnknown},
+	{"\x2e\xa7\xd9\x0b\x00\x00\x00\x10", ProtocolBEP},
+	{"\x2e\xa7\xd9\x0b", ProtocolBEP},
+	{"\x2e\xa7\xd9", ProtocolUnknown},
+	{"\x2e\xa7\xd9\x0c\x00\x00\x00\x10", ProtocolUnknown},
+	{"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", ProtocolHTTP2},
+	{"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n\x00\x00\x12\x04", ProtocolHTTP2},
+	{"PRI * HTTP/2.0\r\n\r\nSM\r\n", ProtocolUnknown},
+	{"PRI * HTTP/1.1\r\nHost: localhost\r\n\r\n", ProtocolUnknown},
+	{"hello", ProtocolUnknown},
+}
+
+func TestIdentify(t *testing.T) {
+	for _, tc := range identifyCases {
+		if proto := identify([]byte(tc.data)); proto != tc.proto {
+			t.Errorf("identify(%q) = %v, expected %v", tc.data, proto, tc.proto)
+		}
+	}
+}
+
+func TestAcceptIdentifiesProtocol(t *testing.T) {
+	for _, tc := range identifyCases {
+		server, client := net.Pipe()
+		l := &DowngradingListener{
+			Listener:    newFakeListener(server),
+			PeekTimeout: 100 * time.Millisecond,
+		}
+
+		go client.Write([]byte(tc.data))
+
+		conn, isTLS, err := l.AcceptNoWrapTLS()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proto := conn.(*UnionedConnection).Protocol; proto != tc.proto {
+			t.Errorf("%q identified as %v, expected %v", tc.data, proto, tc.proto)
+		}
+		if isTLS != (tc.proto == ProtocolTLS) {
+			t.Errorf("%q: incorrect isTLS %v", tc.data, isTLS)
+		}
+
+		// The peeked data must still be readable in full.
+		client.Close()
+		bs, err := ioutil.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(bs) != tc.data {
+			t.Errorf("read %q, expected %q", bs, tc.data)
+		}
+	}
+}
+
+func TestAcceptSOCKS5Greeting(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	l := &DowngradingListener{
+		Listener:    newFakeListener(server),
+		PeekTimeout: 5 * time.Second,
+	}
+
+	// The client sends the short greeting and then waits for our reply,
+	// which must not make us wait for the peek timeout.
+	go client.Write([]byte{0x05, 0x01, 0x00})
+
+	t0 := time.Now()
+	_, proto, err := l.AcceptWithProtocol()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto != ProtocolSOCKS5 {
+		t.Errorf("SOCKS5 greeting identified as %v", proto)
+	}
+	if d := time.Since(t0); d > time.Second {
+		t.Errorf("identification took %v", d)
+	}
+}
+
+func TestAcceptWithProtocol(t *testing.T) {
+	cert := TestCertificate()
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &DowngradingListener{
+		Listener:  raw,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	defer l.Close()
+
+	// A TLS client
+
+	go func() {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, proto, err := l.AcceptWithProtocol()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto != ProtocolTLS {
+		t.Errorf("incorrect protocol %v for TLS client", proto)
+	}
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		t.Fatalf("TLS connection should be wrapped, got %T", conn)
+	}
+	if err := tc.Handshake(); err != nil {
+		t.Error(err)
+	}
+	conn.Close()
+
+	// A plain HTTP client
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+			conn.Close()
+		}
+	}()
+
+	conn, proto, err = l.AcceptWithProtocol()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto != ProtocolHTTP {
+		t.Errorf("incorrect protocol %v for HTTP client", proto)
+	}
+	if _, ok := conn.(*UnionedConnection); !ok {
+		t.Errorf("HTTP connection should not be wrapped, got %T", conn)
+	}
+	conn.Close()
+}
+
+func TestDowngradingListenerCounts(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The clients that fail identification close the connection without
+	// sending anything, so the generous peek timeout never runs out and
+	// slow clients aren't counted as failed under load.
+	l := &DowngradingListener{
+		Listener:    raw,
+		PeekTimeout: 10 * time.Second,
+	}
+	defer l.Close()
+
+	const perKind = 20
+	payloads := []string{"\x16\x03\x01\x00\x05hello", "GET / HTTP/1.1\r\n\r\n", ""}
+
+	var wg sync.WaitGroup
+	for _, payload := range payloads {
+		for i := 0; i < perKind; i++ {
+			wg.Add(1)
+			go func(payload string) {
+				defer wg.Done()
+				conn, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				conn.Write([]byte(payload))
+				conn.Close()
+			}(payload)
+		}
+	}
+
+	var accepters sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		accepters.Add(1)
+		go func() {
+			defer accepters.Done()
+			for j := 0; j < len(payloads)*perKind/10; j++ {
+				conn, _, err := l.AcceptNoWrapTLS()
+				if err != nil && err != ErrIdentificationFailed {
+					t.Error(err)
+					return
+				}
+				conn.Close()
+			}
+		}()
+	}
+
+	wg.Wait()
+	accepters.Wait()
+
+	if n := l.TLSCount(); n != perKind {
+		t.Errorf("TLS count %d != %d", n, perKind)
+	}
+	if n := l.PlainCount(); n != perKind {
+		t.Errorf("plain count %d != %d", n, perKind)
+	}
+	if n := l.FailedCount(); n != perKind {
+		t.Errorf("failed count %d != %d", n, perKind)
+	}
+}
+
+func TestUnionedConnectionReleasesReader(t *testing.T) {
+	server1, client1 := net.Pipe()
+	server2, client2 := net.Pipe()
+	l := &DowngradingListener{
+		Listener:    newFakeListener(server1, server2),
+		PeekTimeout: 100 * time.Millisecond,
+	}
+
+	go func() {
+		client1.Write([]byte("GET /first"))
+		client1.Close()
+	}()
+	first, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Close()
+
+	go func() {
+		client2.Write([]byte("GET /second"))
+		client2.Close()
+	}()
+	second, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	// The closed connection must not see data belonging to the new one,
+	// even if they share a reader.
+	buf := make([]byte, 32)
+	if n, err := first.Read(buf); err == nil || n != 0 {
+		t.Errorf("read %q, %v from closed connection, expected error", buf[:n], err)
+	}
+
+	bs, err := ioutil.ReadAll(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "GET /second" {
+		t.Errorf("read %q, expected %q", bs, "GET /second")
+	}
+}
+
+// A staticConn is a connection that reads the given data and ignores
+// everything else.
+type staticConn struct {
+	net.Conn
+	data []byte
+}
+
+func (c *staticConn) Read(b []byte) (int, error) {
+	if len(c.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, c.data)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func (c *staticConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (c *staticConn) Close() error {
+	return nil
+}
+
+// A staticListener returns a new staticConn from every call to Accept.
+type staticListener struct {
+	net.Listener
+	data []byte
+}
+
+func (l *staticListener) Accept() (net.Conn, error) {
+	return &staticConn{data: l.data}, nil
+}
+
+func BenchmarkAccept(b *testing.B) {
+	l := &DowngradingListener{
+		Listener: &staticListener{data: []byte("GET / HTTP/1.1\r\n\r\n")},
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, _, err := l.AcceptNoWrapTLS()
+		if err != nil {
+			b.Fatal(err)
+		}
+		conn.Close()
+	}
+}
+
+func BenchmarkAcceptBufferSize(b *testing.B) {
+	// The connections are all kept open, as when serving many clients, so
+	// every one of them needs a buffer of its own.
+	const open = 1000
+
+	for _, size := range []int{0, 256, 16} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			conns := make([]net.Conn, open)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				l := &DowngradingListener{
+					Listener:   &staticListener{data: []byte("GET / HTTP/1.1\r\n\r\n")},
+					BufferSize: size,
+				}
+				for j := range conns {
+					conn, _, err := l.AcceptNoWrapTLS()
+					if err != nil {
+						b.Fatal(err)
+					}
+					conns[j] = conn
+				}
+				for _, conn := range conns {
+					conn.Close()
+				}
+			}
+		})
+	}
+}
+
+func TestDowngradingListenerBufferSize(t *testing.T) {
+	cases := []struct {
+		bufferSize int
+		peekLength int
+		proxy      ProxyProtocolMode
+		expected   int
+	}{
+		{0, 0, ProxyProtocolOff, 4096},
+		{256, 0, ProxyProtocolOff, 256},
+		{16, 0, ProxyProtocolOff, sniffLength},
+		{16, 64, ProxyProtocolOff, 64},
+		{16, 8, ProxyProtocolOff, 16},
+		{16, 0, ProxyProtocolOptional, proxyV1MaxLength},
+		{256, 0, ProxyProtocolOptional, 256},
+	}
+
+	for _, tc := range cases {
+		server, client := net.Pipe()
+		l := &DowngradingListener{
+			Listener:      newFakeListener(server),
+			BufferSize:    tc.bufferSize,
+			PeekLength:    tc.peekLength,
+			ProxyProtocol: tc.proxy,
+		}
+		go client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := conn.(*UnionedConnection).br.Size(); size != tc.expected {
+			t.Errorf("buffer size %d, peek length %d: got buffer of %d bytes, expected %d", tc.bufferSize, tc.peekLength, size, tc.expected)
+		}
+		conn.Close()
+		client.Close()
+	}
+}
+
+func TestAcceptRoutesByALPN(t *testing.T) {
+	defaultCert, err := NewCertificateInMemory("default", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bepCert, err := NewCertificateInMemory("bep", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2Cert, err := NewCertificateInMemory("h2", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &DowngradingListener{
+		Listener:  raw,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{defaultCert}},
+		ALPNConfigs: map[string]*tls.Config{
+			"bep/1.0": {Certificates: []tls.Certificate{bepCert}},
+			"h2":      {Certificates: []tls.Certificate{h2Cert}},
+		},
+	}
+	defer l.Close()
+
+	cases := []struct {
+		protos     []string
+		negotiated string
+		commonName string
+	}{
+		{[]string{"bep/1.0"}, "bep/1.0", "bep"},
+		{[]string{"h2", "http/1.1"}, "h2", "h2"},
+		{[]string{"http/1.1"}, "", "default"},
+		{nil, "", "default"},
+	}
+
+	for _, tc := range cases {
+		errs := make(chan error, 1)
+		go func() {
+			conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+				InsecureSkipVerify: true,
+				NextProtos:         tc.protos,
+			})
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			state := conn.ConnectionState()
+			if cn := state.PeerCertificates[0].Subject.CommonName; cn != tc.commonName {
+				errs <- fmt.Errorf("%v: got certificate %q, expected %q", tc.protos, cn, tc.commonName)
+				return
+			}
+			errs <- nil
+		}()
+
+		conn, proto, err := l.AcceptWithProtocol()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proto != ProtocolTLS {
+			t.Errorf("%v: incorrect protocol %v", tc.protos, proto)
+		}
+		if err := conn.(*tls.Conn).Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		state := conn.(*tls.Conn).ConnectionState()
+		if state.NegotiatedProtocol != tc.negotiated {
+			t.Errorf("%v: negotiated %q, expected %q", tc.protos, state.NegotiatedProtocol, tc.negotiated)
+		}
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+		conn.Close()
+	}
+}
+
+func TestAcceptCustomMatchers(t *testing.T) {
+	const (
+		protoHTTP2 = ProtocolCustom + iota
+		protoBEP
+	)
+
+	matchHTTP2 := func(prefix []byte) Protocol {
+		if bytes.HasPrefix(prefix, []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")) {
+			return protoHTTP2
+		}
+		return ProtocolUnknown
+	}
+	matchBEP := func(prefix []byte) Protocol {
+		if bytes.HasPrefix(prefix, []byte{0x2e, 0xa7, 0xd9, 0x0b}) {
+			return protoBEP
+		}
+		return ProtocolUnknown
+	}
+
+	cases := []struct {
+		data  string
+		proto Protocol
+	}{
+		{"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n\x00\x00\x00\x04", protoHTTP2},
+		{"\x2e\xa7\xd9\x0b\x00\x10", protoBEP},
+		{"GET / HTTP/1.1\r\n\r\n", ProtocolHTTP},
+		{"\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03", ProtocolTLS},
+	}
+
+	for _, tc := range cases {
+		server, client := net.Pipe()
+		l := &DowngradingListener{
+			Listener:    newFakeListener(server),
+			PeekTimeout: 100 * time.Millisecond,
+			PeekLength:  24,
+			Matchers:    []MatchFunc{matchHTTP2, matchBEP},
+		}
+
+		// Send the data in small pieces, so that the matchers need to
+		// wait for more than the first read.
+		go func(data string) {
+			for len(data) > 0 {
+				n := 3
+				if n > len(data) {
+					n = len(data)
+				}
+				client.Write([]byte(data[:n]))
+				data = data[n:]
+			}
+			client.Close()
+		}(tc.data)
+
+		conn, proto, err := l.AcceptWithProtocol()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proto != tc.proto {
+			t.Errorf("%q identified as %v, expected %v", tc.data, proto, tc.proto)
+		}
+
+		if proto != ProtocolTLS {
+			// The peeked data must still be readable in full.
+			bs, err := ioutil.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(bs) != tc.data {
+				t.Errorf("read %q, expected %q", bs, tc.data)
+			}
+		}
+		conn.Close()
+	}
+}
+
+// testMatcher matches connections starting with prefix, declaring a peek
+// length of peek.
+type testMatcher struct {
+	proto  Protocol
+	prefix string
+	peek   int
+}
+
+func (m testMatcher) Match(prefix []byte) (Protocol, bool) {
+	return m.proto, bytes.HasPrefix(prefix, []byte(m.prefix))
+}
+
+func (m testMatcher) PeekLength() int {
+	return m.peek
+}
+
+func TestMatcherSet(t *testing.T) {
+	const protoEvents = ProtocolCustom
+
+	if n := DefaultMatchers().PeekLength(); n != sniffLength {
+		t.Errorf("default peek length %d, expected %d", n, sniffLength)
+	}
+
+	// The custom matcher overlaps with HTTP; it only wins when it's tried
+	// first.
+	events := testMatcher{protoEvents, "GET /events ", 40}
+	first := append(MatcherSet{events}, DefaultMatchers()...)
+	last := append(DefaultMatchers(), events)
+
+	if n := first.PeekLength(); n != 40 {
+		t.Errorf("peek length %d, expected the largest declared, 40", n)
+	}
+
+	cases := []struct {
+		set   MatcherSet
+		data  string
+		proto Protocol
+	}{
+		{first, "GET /events HTTP/1.1\r\n", protoEvents},
+		{first, "GET / HTTP/1.1\r\n", ProtocolHTTP},
+		{first, "\x16\x03\x01\x02\x00", ProtocolTLS},
+		{last, "GET /events HTTP/1.1\r\n", ProtocolHTTP},
+		{last, "hello", ProtocolUnknown},
+	}
+	for _, tc := range cases {
+		proto, ok := tc.set.Match([]byte(tc.data))
+		if proto != tc.proto || ok != (tc.proto != ProtocolUnknown) {
+			t.Errorf("Match(%q) = %v, %v, expected %v", tc.data, proto, ok, tc.proto)
+		}
+	}
+}
+
+func TestAcceptMatcherSet(t *testing.T) {
+	const protoLong = ProtocolCustom
+
+	// The magic is longer than any of the built in protocols, so the
+	// listener must wait for more than the default peek length.
+	magic := "syncthing-long-magic-0123456789abcdef"
+	set := append(DefaultMatchers(), testMatcher{protoLong, magic, len(magic)})
+
+	server, client := net.Pipe()
+	l := &DowngradingListener{
+		Listener:    newFakeListener(server),
+		PeekTimeout: time.Second,
+		MatcherSet:  set,
+	}
+	go func() {
+		for i := 0; i < len(magic); i += 8 {
+			j := i + 8
+			if j > len(magic) {
+				j = len(magic)
+			}
+			client.Write([]byte(magic[i:j]))
+		}
+		client.Close()
+	}()
+
+	conn, proto, err := l.AcceptWithProtocol()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if proto != protoLong {
+		t.Errorf("identified as %v, expected %v", proto, protoLong)
+	}
+}
+
+func TestMatchersWithMatcherSet(t *testing.T) {
+	const (
+		protoEvents = ProtocolCustom + iota
+		protoLong
+	)
+
+	matchEvents := func(prefix []byte) Protocol {
+		if bytes.HasPrefix(prefix, []byte("GET /events ")) {
+			return protoEvents
+		}
+		return ProtocolUnknown
+	}
+	long := testMatcher{protoLong, "GET /events HTTP/1.1\r\nHost: x", 40}
+	l := &DowngradingListener{
+		Matchers:   []MatchFunc{matchEvents},
+		MatcherSet: append(MatcherSet{long}, DefaultMatchers()...),
+	}
+
+	// The Matchers come first, so they win over the MatcherSet for the
+	// same prefix; what they don't match goes to the MatcherSet.
+	cases := []struct {
+		data  string
+		proto Protocol
+	}{
+		{"GET /events HTTP/1.1\r\nHost: x", protoEvents},
+		{"GET / HTTP/1.1\r\n", ProtocolHTTP},
+		{"\x16\x03\x01\x02\x00", ProtocolTLS},
+	}
+	matchers := l.matchers()
+	for _, tc := range cases {
+		if proto, _ := matchers.Match([]byte(tc.data)); proto != tc.proto {
+			t.Errorf("%q identified as %v, expected %v", tc.data, proto, tc.proto)
+		}
+	}
+
+	// The peek length is that of the MatcherSet, the Matchers add nothing
+	// to it, and an explicit PeekLength overrides both.
+	if n := l.peekLength(); n != 40 {
+		t.Errorf("peek length %d, expected 40", n)
+	}
+	l.MatcherSet = nil
+	if n := l.peekLength(); n != sniffLength {
+		t.Errorf("peek length %d without a MatcherSet, expected %d", n, sniffLength)
+	}
+	l.PeekLength = 64
+	if n := l.peekLength(); n != 64 {
+		t.Errorf("peek length %d, expected 64", n)
+	}
+}
+
+const webSocketHandshake = "GET /rest/events/ws HTTP/1.1\r\n" +
+	"Host: localhost:8384\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Connection: Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+	"Sec-WebSocket-Version: 13\r\n" +
+	"\r\n"
+
+func TestWebSocketMatcher(t *testing.T) {
+	cases := []struct {
+		data  string
+		proto Protocol
+		ok    bool
+	}{
+		{webSocketHandshake, ProtocolWebSocket, true},
+		{"GET / HTTP/1.1\r\nconnection: upgrade\r\nupgrade: WebSocket\r\n\r\n", ProtocolWebSocket, true},
+		{"GET / HTTP/1.1\r\nUpgrade: foo, websocket\r\n\r\n", ProtocolWebSocket, true},
+		{"GET / HTTP/1.1\r\nUpgrade: h2c\r\n\r\n", ProtocolHTTP, true},
+		{"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", ProtocolHTTP, true},
+		{"GET / HTTP/1.1\r\nX-Upgrade: websocket\r\n\r\n", ProtocolHTTP, true},
+		// Headers not complete yet; undecided.
+		{"GET / HTTP/1.1\r\nHost: localhost\r\n", ProtocolUnknown, true},
+		{"POST / HTTP/1.1\r\nUpgrade: websocket\r\n\r\n", ProtocolUnknown, false},
+		{"\x16\x03\x01\x02\x00", ProtocolUnknown, false},
+	}
+	for _, tc := range cases {
+		proto, ok := WebSocketMatcher.Match([]byte(tc.data))
+		if proto != tc.proto || ok != tc.ok {
+			t.Errorf("Match(%q) = %v, %v, expected %v, %v", tc.data, proto, ok, tc.proto, tc.ok)
+		}
+	}
+}
+
+func TestAcceptWebSocket(t *testing.T) {
+	set := append(MatcherSet{WebSocketMatcher}, DefaultMatchers()...)
+
+	cases := []struct {
+		data  string
+		proto Protocol
+	}{
+		{webSocketHandshake, ProtocolWebSocket},
+		{"GET /rest/events HTTP/1.1\r\nHost: localhost:8384\r\n\r\n", ProtocolHTTP},
+		{"\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03", ProtocolTLS},
+	}
+	for _, tc := range cases {
+		server, client := net.Pipe()
+		l := &DowngradingListener{
+			Listener:    newFakeListener(server),
+			PeekTimeout: time.Second,
+			MatcherSet:  set,
+		}
+
+		// The handshake arrives in pieces and the client then waits for
+		// the response, so identification must not wait for the timeout.
+		go func(data string) {
+			for len(data) > 0 {
+				n := 16
+				if n > len(data) {
+					n = len(data)
+				}
+				client.Write([]byte(data[:n]))
+				data = data[n:]
+			}
+		}(tc.data)
+
+		t0 := time.Now()
+		conn, proto, err := l.AcceptWithProtocol()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proto != tc.proto {
+			t.Errorf("%q identified as %v, expected %v", tc.data, proto, tc.proto)
+		}
+		if d := time.Since(t0); d > 500*time.Millisecond {
+			t.Errorf("identification took %v", d)
+		}
+		conn.Close()
+		client.Close()
+	}
+}
+
+func TestUnionedConnectionWriteTo(t *testing.T) {
+	const data = "GET / HTTP/1.1\r\n\r\nand then some more"
+
+	server, client := net.Pipe()
+	l := &DowngradingListener{
+		Listener:    newFakeListener(server),
+		PeekTimeout: 100 * time.Millisecond,
+	}
+	go func() {
+		client.Write([]byte(data[:10]))
+		client.Write([]byte(data[10:]))
+		client.Close()
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) || buf.String() != data {
+		t.Errorf("copied %d bytes %q, expected %q", n, buf.String(), data)
+	}
+}
+
+func TestUnionedConnectionWithoutListener(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("hello"))
+
+	conn := &UnionedConnection{Reader: server, Conn: server}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("read %q, expected %q", buf, "hello")
+	}
+	if err := conn.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err := client.Write([]byte("late")); err == nil {
+		t.Error("connection should have been closed")
+	}
+}
+
+func TestUnionedConnectionPeeked(t *testing.T) {
+	const data = "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+
+	server, client := net.Pipe()
+	l := &DowngradingListener{
+		Listener:    newFakeListener(server),
+		PeekTimeout: 100 * time.Millisecond,
+	}
+	go func() {
+		client.Write([]byte(data))
+		client.Close()
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc := conn.(*UnionedConnection)
+
+	peeked := uc.Peeked()
+	if !bytes.HasPrefix([]byte(data), peeked) || len(peeked) < sniffLength {
+		t.Errorf("peeked %q, expected a prefix of %q", peeked, data)
+	}
+
+	// Modifying the returned slice must not affect the stream.
+	for i := range peeked {
+		peeked[i] = 'x'
+	}
+
+	bs, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != data {
+		t.Errorf("read %q, expected %q", bs, data)
+	}
+	if peeked := uc.Peeked(); len(peeked) != 0 {
+		t.Errorf("peeked %q after reading everything", peeked)
+	}
+
+	conn.Close()
+	if peeked := uc.Peeked(); peeked != nil {
+		t.Errorf("peeked %q after close", peeked)
+	}
+}
+
+func TestUnionedConnectionPeekedDuringRead(t *testing.T) {
+	const data = "GET / HTTP/1.1\r\n\r\n"
+
+	server, client := net.Pipe()
+	defer client.Close()
+	l := &DowngradingListener{
+		Listener:    newFakeListener(server),
+		PeekTimeout: 100 * time.Millisecond,
+	}
+	go client.Write([]byte(data))
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	uc := conn.(*UnionedConnection)
+
+	// Drain the buffer, then leave a Read waiting for more.
+	if _, err := io.ReadFull(conn, make([]byte, len(data))); err != nil {
+		t.Fatal(err)
+	}
+	readDone := make(chan struct{})
+	go func() {
+		conn.Read(make([]byte, 1))
+		close(readDone)
+	}()
+
+	peeked := make(chan []byte, 1)
+	go func() { peeked <- uc.Peeked() }()
+	select {
+	case bs := <-peeked:
+		if len(bs) != 0 {
+			t.Errorf("peeked %q, expected nothing", bs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Peeked blocked by the pending Read")
+	}
+
+	select {
+	case <-readDone:
+		t.Fatal("Read returned without data")
+	default:
+	}
+	client.Write([]byte("x"))
+	<-readDone
+}
+
+func TestUnionedConnectionReadDeadline(t *testing.T) {
+	const data = "GET / HTTP/1.1\r\n\r\n"
+
+	server, client := net.Pipe()
+	defer client.Close()
+	l := &DowngradingListener{
+		Listener:    newFakeListener(server),
+		PeekTimeout: 100 * time.Millisecond,
+	}
+	go client.Write([]byte(data))
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(-time.Second))
+
+	// The buffered data is returned despite the deadline having passed.
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != data {
+		t.Errorf("read %q, expected %q", buf[:n], data)
+	}
+
+	// With the buffer empty the deadline applies.
+	t0 := time.Now()
+	_, err = conn.Read(buf)
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("expected a timeout error, got %v", err)
+	}
+	if d := time.Since(t0); d > time.Second {
+		t.Errorf("timeout took %v", d)
+	}
+}
+
+func TestUnionedConnectionUnwrap(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &DowngradingListener{Listener: raw}
+	defer l.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+			conn.Close()
+		}
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tc, ok := conn.(*UnionedConnection).Unwrap().(*net.TCPConn)
+	if !ok {
+		t.Fatalf("unwrapped %T, expected *net.TCPConn", conn.(*UnionedConnection).Unwrap())
+	}
+	if err := tc.SetLinger(0); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnionedConnectionCloseWrite(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// With CountBytes the TCP connection is below a CountingConn.
+	l := &DowngradingListener{Listener: raw, CountBytes: true}
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("GET / HTTP/1.1\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		t.Fatal("UnionedConnection should implement CloseWrite")
+	}
+	if err := cw.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client sees EOF, but can still send.
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("client read %v, expected EOF", err)
+	}
+	if _, err := client.Write([]byte("more")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("GET / HTTP/1.1\r\n\r\nmore"))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without support underneath there's an error.
+	server, pipeClient := net.Pipe()
+	defer pipeClient.Close()
+	pl := &DowngradingListener{Listener: newFakeListener(server), PeekTimeout: 10 * time.Millisecond}
+	pconn, err := pl.Accept()
+	if err != nil && err != ErrIdentificationFailed {
+		t.Fatal(err)
+	}
+	defer pconn.Close()
+	if err := pconn.(*UnionedConnection).CloseWrite(); err == nil {
+		t.Error("unexpected nil error from CloseWrite on a net.Pipe")
+	}
+}
+
+func TestUnionedConnectionSyscallConn(t *testing.T) {
+	const data = "GET / HTTP/1.1\r\n\r\n"
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &DowngradingListener{Listener: raw, CountBytes: true}
+	defer l.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			conn.Write([]byte(data))
+			conn.Close()
+		}
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		t.Fatal("UnionedConnection should implement syscall.Conn")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	called := false
+	if err := rc.Control(func(fd uintptr) { called = true }); err != nil {
+		t.Fatal(err)
+	}
+	if !called {
+		t.Error("Control function was not called")
+	}
+
+	// The buffered data is unaffected.
+	bs, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != data {
+		t.Errorf("read %q, expected %q", bs, data)
+	}
+}
+
+func TestUnionedConnectionDelegates(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &DowngradingListener{Listener: raw, CountBytes: true}
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("GET / HTTP/1.1\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	uc := conn.(*UnionedConnection)
+	tc := baseConn(uc.Unwrap()).(*net.TCPConn)
+
+	if uc.LocalAddr().String() != tc.LocalAddr().String() || uc.LocalAddr().String() != client.RemoteAddr().String() {
+		t.Errorf("local address %v, expected %v", uc.LocalAddr(), tc.LocalAddr())
+	}
+	if uc.RemoteAddr().String() != tc.RemoteAddr().String() || uc.RemoteAddr().String() != client.LocalAddr().String() {
+		t.Errorf("remote address %v, expected %v", uc.RemoteAddr(), tc.RemoteAddr())
+	}
+
+	// Deadlines apply to the connection once the buffer is drained.
+	if _, err := io.ReadFull(uc, make([]byte, len("GET / HTTP/1.1\r\n\r\n"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := uc.SetDeadline(time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = tc.Read(make([]byte, 1))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("read %v on the underlying connection, expected a timeout", err)
+	}
+	if err := uc.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := uc.SetWriteDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uc.Write([]byte("ok")); err != nil {
+		t.Error(err)
+	}
+
+	f, err := uc.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func BenchmarkUnionedConnectionCopy(b *testing.B) {
+	b.Run("WriteTo", func(b *testing.B) {
+		benchmarkCopy(b, func(conn net.Conn) io.Reader { return conn })
+	})
+	b.Run("Read", func(b *testing.B) {
+		// Hide WriteTo, forcing io.Copy through Read.
+		benchmarkCopy(b, func(conn net.Conn) io.Reader { return struct{ io.Reader }{conn} })
+	})
+}
+
+// benchmarkCopy copies plain data from a connection accepted by a
+// DowngradingListener to another TCP connection.
+func benchmarkCopy(b *testing.B, wrap func(net.Conn) io.Reader) {
+	const chunkSize = 64 << 10
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	l := &DowngradingListener{Listener: raw}
+	defer l.Close()
+	sink, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sink.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("GET "))
+		chunk := make([]byte, chunkSize)
+		for i := 0; i < b.N; i++ {
+			if _, err := conn.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		conn, err := sink.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	in, err := l.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer in.Close()
+	out, err := net.Dial("tcp", sink.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer out.Close()
+
+	b.SetBytes(chunkSize)
+	b.ResetTimer()
+	if _, err := io.Copy(out, wrap(in)); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func TestAcceptSelectsBySNI(t *testing.T) {
+	defaultCert, err := NewCertificateInMemory("default", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncCert, err := NewCertificateInMemory("sync.example.com", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiCert, err := NewCertificateInMemory("api.example.com", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &DowngradingListener{
+		Listener:  raw,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{defaultCert}},
+		SNIConfigs: map[string]*tls.Config{
+			"sync.example.com": {Certificates: []tls.Certificate{syncCert}},
+			"api.example.com":  {Certificates: []tls.Certificate{apiCert}},
+		},
+	}
+	defer l.Close()
+
+	cases := []struct {
+		serverName string
+		commonName string
+	}{
+		{"sync.example.com", "sync.example.com"},
+		{"API.example.com", "api.example.com"},
+		{"other.example.com", "default"},
+		{"", "default"},
+	}
+
+	for _, tc := range cases {
+		names := make(chan string, 1)
+		go func() {
+			conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+				InsecureSkipVerify: true,
+				ServerName:         tc.serverName,
+			})
+			if err != nil {
+				names <- err.Error()
+				return
+			}
+			defer conn.Close()
+			names <- conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		}()
+
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.(*tls.Conn).Handshake(); err != nil {
+			t.Errorf("%q: %v", tc.serverName, err)
+		}
+		if cn := <-names; cn != tc.commonName {
+			t.Errorf("%q: got certificate %q, expected %q", tc.serverName, cn, tc.commonName)
+		}
+		conn.Close()
+	}
+}
+
+func TestAcceptResumesSessions(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := TestCertificate()
+	l := &DowngradingListener{
+		Listener:    raw,
+		TLSConfig:   &tls.Config{Certificates: []tls.Certificate{cert}},
+		SNIConfigs:  map[string]*tls.Config{"sync.example.com": {Certificates: []tls.Certificate{cert}}},
+		ALPNConfigs: map[string]*tls.Config{"bep/1.0": {Certificates: []tls.Certificate{cert}}},
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if tc, ok := conn.(*tls.Conn); ok {
+				tc.Handshake()
+			}
+			conn.Close()
+		}
+	}()
+
+	cases := []struct {
+		name       string
+		serverName string
+		protos     []string
+	}{
+		{"default", "", nil},
+		{"SNI", "sync.example.com", nil},
+		{"ALPN", "", []string{"bep/1.0"}},
+	}
+
+	for _, tc := range cases {
+		// TLS 1.2 sends the ticket as part of the handshake, sparing us
+		// from reading it from the connection.
+		clientCfg := &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         tc.serverName,
+			NextProtos:         tc.protos,
+			MaxVersion:         tls.VersionTLS12,
+			ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		}
+		for i := 0; i < 2; i++ {
+			conn, err := tls.Dial("tcp", l.Addr().String(), clientCfg)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			if resumed := conn.ConnectionState().DidResume; resumed != (i == 1) {
+				t.Errorf("%s: connection %d resumed %v, expected %v", tc.name, i, resumed, i == 1)
+			}
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDowngradingListenerTCPOptions(t *testing.T) {
+	cases := []struct {
+		keepAlive      time.Duration
+		disableNoDelay bool
+		wantKeepAlive  int // seconds, zero for off
+		wantNoDelay    bool
+	}{
+		{0, false, 30, true},
+		{10 * time.Second, true, 10, false},
+		{-1, false, 0, true},
+	}
+
+	for _, tc := range cases {
+		raw, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := &DowngradingListener{
+			Listener:       raw,
+			KeepAlive:      tc.keepAlive,
+			DisableNoDelay: tc.disableNoDelay,
+		}
+
+		go func() {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err == nil {
+				conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+				conn.Close()
+			}
+		}()
+
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keepAlive, idle, noDelay := socketOptions(t, conn.(*UnionedConnection).Unwrap().(*net.TCPConn))
+		if tc.wantKeepAlive == 0 && keepAlive {
+			t.Errorf("keep-alive %v: keep-alive should be off", tc.keepAlive)
+		}
+		if tc.wantKeepAlive != 0 && (!keepAlive || idle != tc.wantKeepAlive) {
+			t.Errorf("keep-alive %v: got keep-alive %v with period %ds, expected %ds", tc.keepAlive, keepAlive, idle, tc.wantKeepAlive)
+		}
+		if noDelay != tc.wantNoDelay {
+			t.Errorf("keep-alive %v: no-delay %v, expected %v", tc.keepAlive, noDelay, tc.wantNoDelay)
+		}
+
+		conn.Close()
+		l.Close()
+	}
+}
+
+func socketOptions(t *testing.T, conn *net.TCPConn) (keepAlive bool, idle int, noDelay bool) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		var v int
+		if v, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); serr != nil {
+			return
+		}
+		keepAlive = v != 0
+		if idle, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); serr != nil {
+			return
+		}
+		v, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+		noDelay = v != 0
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return keepAlive, idle, noDelay
+}
@@ -0,0 +1,39 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+)
+
+var (
+	testCertOnce sync.Once
+	testCert     tls.Certificate
+)
+
+// TestCertificate returns an ECDSA certificate for use in tests, where
+// generating an RSA certificate for every test is too slow. It's generated
+// on the first call and the same certificate is returned from then on, so
+// it must not be modified. Never use it for anything but tests.
+func TestCertificate() tls.Certificate {
+	testCertOnce.Do(func() {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		testCert, err = newKeyPair(CertificateOptions{CommonName: "syncthing"}, x509.ECDSAWithSHA256, priv)
+		if err != nil {
+			panic(err)
+		}
+	})
+	return testCert
+}
@@ -0,0 +1,42 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestTestCertificate(t *testing.T) {
+	first := TestCertificate()
+	if first.Leaf == nil || len(first.Certificate) == 0 {
+		t.Fatal("incomplete certificate")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if cert := TestCertificate(); !bytes.Equal(cert.Certificate[0], first.Certificate[0]) {
+				t.Error("different certificate returned")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := testHandshake(first); err != nil {
+		t.Error(err)
+	}
+}
+
+func BenchmarkTestCertificate(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		TestCertificate()
+	}
+}
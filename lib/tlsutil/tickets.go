@@ -0,0 +1,78 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WithoutSessionTickets disables session resumption using tickets in cfg,
+// and returns cfg. Anyone holding the ticket key can decrypt the sessions
+// resumed with it, so doing without tickets avoids depending on the key
+// being kept secret, at the cost of a full handshake for every connection.
+func WithoutSessionTickets(cfg *tls.Config) *tls.Config {
+	cfg.SessionTicketsDisabled = true
+	return cfg
+}
+
+// A SessionTicketRotator regularly replaces the session ticket key of a
+// server configuration, limiting how many sessions a leaked key exposes.
+// The previous key is kept for decryption only, so that tickets issued just
+// before a rotation stay valid for another interval.
+type SessionTicketRotator struct {
+	cfg *tls.Config
+
+	mut  sync.Mutex
+	keys [][32]byte
+}
+
+// NewSessionTicketRotator sets a new random session ticket key on cfg and
+// returns a rotator for it. As the keys are set on cfg itself, it must be
+// the configuration used by the server, not a copy of it.
+func NewSessionTicketRotator(cfg *tls.Config) (*SessionTicketRotator, error) {
+	r := &SessionTicketRotator{cfg: cfg}
+	if err := r.Rotate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Rotate starts using a new random key for session tickets.
+func (r *SessionTicketRotator) Rotate() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return fmt.Errorf("session ticket key: %s", err)
+	}
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.keys = append([][32]byte{key}, r.keys...)
+	if len(r.keys) > 2 {
+		r.keys = r.keys[:2]
+	}
+	r.cfg.SetSessionTicketKeys(r.keys)
+	return nil
+}
+
+// Run rotates the key every interval until ctx is cancelled.
+func (r *SessionTicketRotator) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.Rotate()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
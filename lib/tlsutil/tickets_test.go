@@ -0,0 +1,116 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+// resumes returns whether a second connection from the client resumes the
+// session of the first.
+func resumes(t *testing.T, serverCfg *tls.Config, between func()) bool {
+	// TLS 1.2 sends the ticket as part of the handshake, sparing us from
+	// reading it from the connection.
+	clientCfg := &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+
+	state, err := handshakeConfigs(serverCfg, clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.DidResume {
+		t.Fatal("first connection resumed")
+	}
+
+	if between != nil {
+		between()
+	}
+
+	state, err = handshakeConfigs(serverCfg, clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state.DidResume
+}
+
+func TestWithoutSessionTickets(t *testing.T) {
+	cfg := &tls.Config{Certificates: []tls.Certificate{TestCertificate()}}
+	if !resumes(t, cfg, nil) {
+		t.Fatal("session should resume with tickets enabled")
+	}
+
+	cfg = WithoutSessionTickets(&tls.Config{Certificates: []tls.Certificate{TestCertificate()}})
+	if resumes(t, cfg, nil) {
+		t.Error("session resumed with tickets disabled")
+	}
+}
+
+func TestSessionTicketRotator(t *testing.T) {
+	cfg := &tls.Config{Certificates: []tls.Certificate{TestCertificate()}}
+	r, err := NewSessionTicketRotator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A ticket survives one rotation, but not two.
+	rotate := func(n int) func() {
+		return func() {
+			for i := 0; i < n; i++ {
+				if err := r.Rotate(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	if !resumes(t, cfg, rotate(1)) {
+		t.Error("session should resume after one rotation")
+	}
+	if resumes(t, cfg, rotate(2)) {
+		t.Error("session resumed after two rotations")
+	}
+}
+
+func TestSecureDefaultTLSConfigSessionTickets(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg, err := SecureDefaultTLSConfigWithOptions(ctx, TestCertificate(), ConfigOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resumes(t, cfg, nil) {
+		t.Error("session should resume by default")
+	}
+
+	cfg, err = SecureDefaultTLSConfigWithOptions(ctx, TestCertificate(), ConfigOptions{DisableSessionTickets: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumes(t, cfg, nil) {
+		t.Error("session resumed with tickets disabled")
+	}
+
+	// Waiting for many rotations leaves the ticket with a retired key.
+	const interval = 10 * time.Millisecond
+	cfg, err = SecureDefaultTLSConfigWithOptions(ctx, TestCertificate(), ConfigOptions{SessionTicketRotation: interval})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumes(t, cfg, func() { time.Sleep(50 * interval) }) {
+		t.Error("session resumed after the key was rotated")
+	}
+
+	if _, err := SecureDefaultTLSConfigWithOptions(ctx, TestCertificate(), ConfigOptions{DisableSessionTickets: true, SessionTicketRotation: interval}); err == nil {
+		t.Error("rotation accepted with tickets disabled")
+	}
+}
@@ -8,131 +8,1741 @@ package tlsutil
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/big"
-	mr "math/rand"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/syncthing/syncthing/lib/osutil"
 )
 
 var (
 	ErrIdentificationFailed = fmt.Errorf("failed to identify socket type")
+	ErrNoKeyUsage           = fmt.Errorf("no extended key usage given")
 )
 
+// DefaultClockSkew is how far back in time the validity of a new certificate
+// starts by default, so that it is accepted straight away by peers whose
+// clocks are somewhat behind.
+const DefaultClockSkew = 24 * time.Hour
+
+// MinRSABits is the smallest RSA key size we generate.
+const MinRSABits = 2048
+
+// progressInterval is how often CertificateOptions.Progress is called.
+var progressInterval = 1 * time.Second
+
+// CertificateOptions controls the properties of a generated certificate.
+type CertificateOptions struct {
+	// CommonName is the common name of the certificate subject.
+	CommonName string
+
+	// Organization and OrganizationalUnit are added to the certificate
+	// subject, if set.
+	Organization       []string
+	OrganizationalUnit []string
+
+	// RSABits is the size of the generated RSA key. Sizes below MinRSABits
+	// are rejected with an error.
+	RSABits int
+
+	// Progress, if set, is called about every second while the RSA key is
+	// being generated by NewCertificateContext, which can take a long time
+	// for large keys on slow hardware.
+	Progress func()
+
+	// ECDSAFallback, if set, makes NewCertificateContext give up on
+	// generating an RSA key when there is less than ECDSAFallback left
+	// until the context deadline, and create a certificate with a P-256
+	// ECDSA key instead, which is quick. NewCertificateContext always sets
+	// the Leaf of the returned certificate, and its PublicKeyAlgorithm is
+	// x509.ECDSA if the fallback was used and x509.RSA otherwise. Without a
+	// context deadline there is no fallback.
+	ECDSAFallback time.Duration
+
+	// PKCS8 selects a PKCS#8 ("PRIVATE KEY") encoding of the private key
+	// instead of the default PKCS#1 ("RSA PRIVATE KEY").
+	PKCS8 bool
+
+	// Passphrase, if set, causes the private key to be written as an
+	// encrypted PKCS#8 ("ENCRYPTED PRIVATE KEY") block. Such keys must be
+	// loaded using LoadKeyPairEncrypted.
+	Passphrase string
+
+	// CertFileMode and KeyFileMode set the permissions of the written
+	// certificate and key files. By default the certificate file is
+	// created with mode 0666 and the key file with mode 0600, both subject
+	// to the umask. Explicitly set modes are applied as is.
+	CertFileMode os.FileMode
+	KeyFileMode  os.FileMode
+
+	// Validity is the lifetime of the certificate, starting now. The zero
+	// value means the certificate is valid until the end of 2049.
+	Validity time.Duration
+
+	// ClockSkew is how far in the past the validity period starts. The
+	// zero value means DefaultClockSkew, a negative value means the
+	// validity period starts now.
+	ClockSkew time.Duration
+
+	// DNSNames and IPAddresses are added to the certificate as subject
+	// alternative names. IP addresses given as DNS names, which clients
+	// would never match, are added as IP addresses instead. IPv6 zones, as
+	// in "fe80::1%eth0", can't be part of a subject alternative name and
+	// are removed.
+	DNSNames    []string
+	IPAddresses []net.IP
+
+	// InterfaceAddresses adds "localhost", 127.0.0.1 and the addresses of
+	// the host's non-loopback network interfaces as subject alternative
+	// names, so the certificate is valid for however the host is reached
+	// on the LAN. ExcludeLinkLocal leaves out link local addresses.
+	InterfaceAddresses bool
+	ExcludeLinkLocal   bool
+
+	// MustStaple adds the TLS feature extension telling clients to require
+	// a stapled OCSP response, as served by OCSPStapler. Only use it for
+	// certificates signed by a CA with an OCSP responder, using
+	// SignCertificateWithOptions.
+	MustStaple bool
+
+	// OmitKeyIdentifiers leaves out the subject key identifier extension,
+	// which some validators expect and is added by default.
+	OmitKeyIdentifiers bool
+
+	// PreviousSerials are serial numbers the certificate must not have, as
+	// some audit tools flag reuse. RenewCertificate adds the serial of the
+	// certificate it replaces.
+	PreviousSerials []*big.Int
+
+	// KeyUsage and ExtKeyUsage override the default usages, which allow the
+	// certificate to be used for both server and client authentication. A
+	// non-nil but empty ExtKeyUsage is an error.
+	KeyUsage    x509.KeyUsage
+	ExtKeyUsage []x509.ExtKeyUsage
+}
+
 func NewCertificate(certFile, keyFile, tlsDefaultCommonName string, tlsRSABits int) (tls.Certificate, error) {
-	priv, err := rsa.GenerateKey(rand.Reader, tlsRSABits)
+	return NewCertificateContext(context.Background(), certFile, keyFile, CertificateOptions{
+		CommonName: tlsDefaultCommonName,
+		RSABits:    tlsRSABits,
+	})
+}
+
+// LoadOrGenerateCertificate loads the certificate and key from the given
+// files, or generates a new certificate using NewCertificate if neither
+// exists. Files that exist but can't be loaded, or only one of the two
+// existing, result in an error; existing files are never overwritten. The
+// exception is a valid certificate and key that don't belong together, as
+// left by an interrupted regeneration, which are replaced by a new
+// certificate.
+func LoadOrGenerateCertificate(certFile, keyFile, commonName string, rsaBits int) (tls.Certificate, error) {
+	return LoadOrGenerateCertificateWithOptions(certFile, keyFile, LoadOptions{
+		Certificate: CertificateOptions{
+			CommonName: commonName,
+			RSABits:    rsaBits,
+		},
+	})
+}
+
+// DefaultNotYetValidMargin is how far in the future a certificate's NotBefore
+// may be before LoadOptions.RegenerateInvalid considers it unusable.
+const DefaultNotYetValidMargin = 24 * time.Hour
+
+// LoadOptions are the options for LoadOrGenerateCertificateWithOptions.
+type LoadOptions struct {
+	// Certificate are the options for generating a new certificate.
+	Certificate CertificateOptions
+
+	// RegenerateInvalid replaces a loaded certificate that has expired, or
+	// that isn't valid until more than NotYetValidMargin from now, with a
+	// newly generated one. This typically happens to certificates generated
+	// while the clock was wrong. As the device ID changes, this is logged
+	// as a warning to Logger, if set.
+	RegenerateInvalid bool
+
+	// NotYetValidMargin overrides DefaultNotYetValidMargin, if set.
+	NotYetValidMargin time.Duration
+
+	Logger Logger
+}
+
+// LoadOrGenerateCertificateWithOptions is like LoadOrGenerateCertificate,
+// with additional options. Files that can't be loaded are still never
+// overwritten, except for a mismatched certificate and key.
+func LoadOrGenerateCertificateWithOptions(certFile, keyFile string, opts LoadOptions) (tls.Certificate, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		return NewCertificateContext(context.Background(), certFile, keyFile, opts.Certificate)
+	}
+
+	// With only one of the files missing the load fails, rather than
+	// replacing the other one.
+	cert, err := withLeaf(tls.LoadX509KeyPair(certFile, keyFile))
+	if err != nil && mismatchedKeyPair(certFile, keyFile) {
+		cert, err = NewCertificateContext(context.Background(), certFile, keyFile, opts.Certificate)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("regenerate cert: %s", err)
+		}
+		if opts.Logger != nil {
+			opts.Logger.Warnf("Certificate %s does not match the key in %s and has been regenerated. The device ID has changed to %s!", certFile, keyFile, deviceIDFromRaw(cert.Certificate[0]))
+		}
+		return cert, nil
+	}
+	if err != nil || !opts.RegenerateInvalid {
+		return cert, err
+	}
+
+	margin := opts.NotYetValidMargin
+	if margin == 0 {
+		margin = DefaultNotYetValidMargin
+	}
+	now := time.Now()
+	var reason string
+	switch {
+	case now.After(cert.Leaf.NotAfter):
+		reason = fmt.Sprintf("expired at %v", cert.Leaf.NotAfter)
+	case cert.Leaf.NotBefore.After(now.Add(margin)):
+		reason = fmt.Sprintf("is not valid until %v", cert.Leaf.NotBefore)
+	default:
+		return cert, nil
+	}
+
+	oldID := deviceIDFromRaw(cert.Certificate[0])
+	certOpts := opts.Certificate
+	certOpts.PreviousSerials = append(append([]*big.Int(nil), certOpts.PreviousSerials...), cert.Leaf.SerialNumber)
+	cert, err = NewCertificateContext(context.Background(), certFile, keyFile, certOpts)
 	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("generate key: %s", err)
+		return tls.Certificate{}, fmt.Errorf("regenerate cert: %s", err)
+	}
+	if opts.Logger != nil {
+		opts.Logger.Warnf("Certificate %s %s and has been regenerated. The device ID has changed from %s to %s!", certFile, reason, oldID, deviceIDFromRaw(cert.Certificate[0]))
 	}
+	return cert, nil
+}
 
-	notBefore := time.Now()
-	notAfter := time.Date(2049, 12, 31, 23, 59, 59, 0, time.UTC)
+// mismatchedKeyPair returns whether certFile and keyFile hold a valid
+// certificate and an unencrypted private key, but the key doesn't belong to
+// the certificate.
+func mismatchedKeyPair(certFile, keyFile string) bool {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return false
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return false
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || certBlock.Type != "CERTIFICATE" || keyBlock == nil {
+		return false
+	}
+	leaf, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return false
+	}
 
-	template := x509.Certificate{
-		SerialNumber: new(big.Int).SetInt64(mr.Int63()),
-		Subject: pkix.Name{
-			CommonName: tlsDefaultCommonName,
-		},
-		NotBefore: notBefore,
-		NotAfter:  notAfter,
+	var priv interface{}
+	switch keyBlock.Type {
+	case "RSA PRIVATE KEY":
+		priv, err = x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	case "EC PRIVATE KEY":
+		priv, err = x509.ParseECPrivateKey(keyBlock.Bytes)
+	case "PRIVATE KEY":
+		priv, err = x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	default:
+		return false
+	}
+	if err != nil {
+		return false
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return false
+	}
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	return ok && !pub.Equal(leaf.PublicKey)
+}
 
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
-		BasicConstraintsValid: true,
-		SignatureAlgorithm:    x509.SHA256WithRSA,
+// RenewCertificate replaces the certificate in certFile with a new one with
+// the given validity, reusing the subject and the private key in keyFile.
+// The key file is not modified, and the certificate file keeps its mode.
+// Note that as the certificate changes, so does the device ID; the new
+// device ID is returned. Only self signed certificates can be renewed this
+// way; others must be reissued by their CA.
+func RenewCertificate(certFile, keyFile string, validity time.Duration) (DeviceID, error) {
+	old, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return DeviceID{}, err
+	}
+	leaf, err := leafCertificate(old)
+	if err != nil {
+		return DeviceID{}, err
+	}
+	if !bytes.Equal(leaf.RawIssuer, leaf.RawSubject) || leaf.CheckSignature(leaf.SignatureAlgorithm, leaf.RawTBSCertificate, leaf.Signature) != nil {
+		return DeviceID{}, errors.New("renew cert: certificate is not self signed")
+	}
+	info, err := os.Stat(certFile)
+	if err != nil {
+		return DeviceID{}, err
+	}
+	priv, ok := old.PrivateKey.(crypto.Signer)
+	if !ok {
+		return DeviceID{}, fmt.Errorf("unsupported private key type %T", old.PrivateKey)
 	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	opts := CertificateOptions{
+		CommonName:         leaf.Subject.CommonName,
+		Organization:       leaf.Subject.Organization,
+		OrganizationalUnit: leaf.Subject.OrganizationalUnit,
+		Validity:           validity,
+		DNSNames:           leaf.DNSNames,
+		IPAddresses:        leaf.IPAddresses,
+		KeyUsage:           leaf.KeyUsage,
+		ExtKeyUsage:        leaf.ExtKeyUsage,
+		PreviousSerials:    []*big.Int{leaf.SerialNumber},
+	}
+	cert, err := newKeyPair(opts, leaf.SignatureAlgorithm, priv)
 	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("create cert: %s", err)
+		return DeviceID{}, err
 	}
 
-	certOut, err := os.Create(certFile)
+	certOut, err := createTemp(certFile, info.Mode().Perm(), 0666)
 	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("save cert: %s", err)
+		return DeviceID{}, fmt.Errorf("save cert: %s", err)
+	}
+	defer os.Remove(certOut.Name())
+	defer certOut.Close()
+
+	if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}); err != nil {
+		return DeviceID{}, fmt.Errorf("save cert: %s", err)
+	}
+	if err := syncClose(certOut); err != nil {
+		return DeviceID{}, fmt.Errorf("save cert: %s", err)
+	}
+	if err := osutil.Rename(certOut.Name(), certFile); err != nil {
+		return DeviceID{}, fmt.Errorf("save cert: %s", err)
+	}
+
+	return DeviceIDFromCertificate(cert)
+}
+
+// NewCertificateWithOptions is like NewCertificate, but with the certificate
+// properties given by opts.
+func NewCertificateWithOptions(certFile, keyFile string, opts CertificateOptions) (tls.Certificate, error) {
+	return NewCertificateContext(context.Background(), certFile, keyFile, opts)
+}
+
+// NewCertificateContext is like NewCertificateWithOptions, but gives up and
+// returns the context error if ctx is cancelled before key generation is
+// complete. The returned certificate has Leaf set; see
+// CertificateOptions.ECDSAFallback for telling which kind of key it got.
+func NewCertificateContext(ctx context.Context, certFile, keyFile string, opts CertificateOptions) (tls.Certificate, error) {
+	rsaCtx := ctx
+	deadline, hasDeadline := ctx.Deadline()
+	if opts.ECDSAFallback > 0 && hasDeadline {
+		var cancel context.CancelFunc
+		rsaCtx, cancel = context.WithDeadline(ctx, deadline.Add(-opts.ECDSAFallback))
+		defer cancel()
+	}
+
+	priv, err := generateRSAKey(rsaCtx, opts.RSABits, opts.Progress)
+	if err == context.DeadlineExceeded && rsaCtx != ctx && ctx.Err() == nil {
+		ecPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("generate key: %s", err)
+		}
+		return saveCertificate(certFile, keyFile, opts, x509.ECDSAWithSHA256, ecPriv)
 	}
-	err = pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
 	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("save cert: %s", err)
+		return tls.Certificate{}, err
+	}
+
+	return saveCertificate(certFile, keyFile, opts, x509.SHA256WithRSA, priv)
+}
+
+// NewCertificateTo is like NewCertificate, but writes the PEM encoded
+// certificate and key to the given writers instead of to files.
+func NewCertificateTo(certOut, keyOut io.Writer, commonName string, rsaBits int) (tls.Certificate, error) {
+	priv, err := generateRSAKey(context.Background(), rsaBits, nil)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	opts := CertificateOptions{
+		CommonName: commonName,
+		RSABits:    rsaBits,
+	}
+	return encodeCertificate(certOut, keyOut, opts, x509.SHA256WithRSA, priv)
+}
+
+// NewCertificateEncrypted is like NewCertificate, but encrypts the private
+// key file using the given passphrase.
+func NewCertificateEncrypted(certFile, keyFile, commonName string, rsaBits int, passphrase string) (tls.Certificate, error) {
+	return NewCertificateWithOptions(certFile, keyFile, CertificateOptions{
+		CommonName: commonName,
+		RSABits:    rsaBits,
+		Passphrase: passphrase,
+	})
+}
+
+// LoadKeyPairFromPEM returns the certificate from PEM encoded certificate
+// and key data, with Leaf set.
+func LoadKeyPairFromPEM(certPEM, keyPEM []byte) (tls.Certificate, error) {
+	return withLeaf(tls.X509KeyPair(certPEM, keyPEM))
+}
+
+// LoadKeyPairEncrypted is like tls.LoadX509KeyPair, but for a private key
+// file encrypted with the given passphrase.
+func LoadKeyPairEncrypted(certFile, keyFile, passphrase string) (tls.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return tls.Certificate{}, fmt.Errorf("load key: no PEM data in %s", keyFile)
+	}
+	der, err := decryptPKCS8(block, passphrase)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("load key: %s", err)
+	}
+	if _, err := x509.ParsePKCS8PrivateKey(der); err != nil {
+		// Valid padding by chance, but garbage data.
+		return tls.Certificate{}, fmt.Errorf("load key: %s", ErrIncorrectPassphrase)
+	}
+
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return withLeaf(tls.X509KeyPair(certPEM, keyPEM))
+}
+
+// rsaGenerateKey is rsa.GenerateKey, unless replaced by tests.
+var rsaGenerateKey = rsa.GenerateKey
+
+// generateRSAKey generates an RSA key of the given size, calling progress,
+// if not nil, every progressInterval until done. It returns the context
+// error if ctx is cancelled first; the key generation itself can't be
+// interrupted, so it runs to completion in the background and the result is
+// discarded.
+func generateRSAKey(ctx context.Context, bits int, progress func()) (*rsa.PrivateKey, error) {
+	if bits < MinRSABits {
+		return nil, fmt.Errorf("generate key: RSA key size %d is below the minimum of %d bits", bits, MinRSABits)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		priv *rsa.PrivateKey
+		err  error
+	}
+	res := make(chan result, 1)
+	generate := rsaGenerateKey
+	go func() {
+		priv, err := generate(rand.Reader, bits)
+		res <- result{priv, err}
+	}()
+
+	var tick <-chan time.Time
+	if progress != nil {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case r := <-res:
+			if r.err != nil {
+				return nil, fmt.Errorf("generate key: %s", r.err)
+			}
+			return r.priv, nil
+		case <-tick:
+			progress()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// NewCertificateECDSA is like NewCertificate, but generates an ECDSA key on
+// the given curve instead of an RSA key. This is considerably faster and
+// gives smaller certificates. The curve must be P-256, P-384 or P-521; nil
+// means P-256. The certificate is signed using a hash of matching strength.
+func NewCertificateECDSA(certFile, keyFile, commonName string, curve elliptic.Curve) (tls.Certificate, error) {
+	if curve == nil {
+		curve = elliptic.P256()
+	}
+	sigAlgo, err := ecdsaSignatureAlgorithm(curve)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generate key: %s", err)
+	}
+
+	return saveCertificate(certFile, keyFile, CertificateOptions{CommonName: commonName}, sigAlgo, priv)
+}
+
+// ecdsaSignatureAlgorithm returns the signature algorithm to use with keys
+// on the given curve, or an error for unsupported curves.
+func ecdsaSignatureAlgorithm(curve elliptic.Curve) (x509.SignatureAlgorithm, error) {
+	switch curve {
+	case elliptic.P256():
+		return x509.ECDSAWithSHA256, nil
+	case elliptic.P384():
+		return x509.ECDSAWithSHA384, nil
+	case elliptic.P521():
+		return x509.ECDSAWithSHA512, nil
+	default:
+		return x509.UnknownSignatureAlgorithm, fmt.Errorf("generate key: unsupported curve %s", curve.Params().Name)
 	}
-	err = certOut.Close()
+}
+
+// NewCertificateEd25519 is like NewCertificate, but generates an Ed25519
+// key instead of an RSA key.
+func NewCertificateEd25519(certFile, keyFile, commonName string) (tls.Certificate, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generate key: %s", err)
+	}
+
+	return saveCertificate(certFile, keyFile, CertificateOptions{CommonName: commonName}, x509.PureEd25519, priv)
+}
+
+// NewCertificateInMemory is like NewCertificate, but returns the
+// certificate and key without writing them to disk.
+func NewCertificateInMemory(commonName string, rsaBits int) (tls.Certificate, error) {
+	priv, err := generateRSAKey(context.Background(), rsaBits, nil)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return newKeyPair(CertificateOptions{CommonName: commonName, RSABits: rsaBits}, x509.SHA256WithRSA, priv)
+}
+
+// saveCertificate creates a self signed certificate for the given private
+// key and saves it and the PEM encoded key to the given files.
+func saveCertificate(certFile, keyFile string, opts CertificateOptions, sigAlgo x509.SignatureAlgorithm, priv crypto.Signer) (tls.Certificate, error) {
+	// Both files are written to temporary files first, and only moved into
+	// place once both have been written successfully. The two renames
+	// can't be made atomic together: an interruption between them leaves
+	// the new key with the old certificate, which LoadOrGenerateCertificate
+	// detects and regenerates, or with no certificate at all if there was
+	// none before, which it reports as an error.
+	certOut, err := createTemp(certFile, opts.CertFileMode, 0666)
 	if err != nil {
 		return tls.Certificate{}, fmt.Errorf("save cert: %s", err)
 	}
+	defer os.Remove(certOut.Name())
+	defer certOut.Close()
 
-	keyOut, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	keyOut, err := createTemp(keyFile, opts.KeyFileMode, 0600)
 	if err != nil {
 		return tls.Certificate{}, fmt.Errorf("save key: %s", err)
 	}
-	err = pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	defer os.Remove(keyOut.Name())
+	defer keyOut.Close()
+
+	cert, err := encodeCertificate(certOut, keyOut, opts, sigAlgo, priv)
 	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if err := syncClose(keyOut); err != nil {
 		return tls.Certificate{}, fmt.Errorf("save key: %s", err)
 	}
-	err = keyOut.Close()
+	if err := syncClose(certOut); err != nil {
+		return tls.Certificate{}, fmt.Errorf("save cert: %s", err)
+	}
+	if err := osutil.Rename(keyOut.Name(), keyFile); err != nil {
+		return tls.Certificate{}, fmt.Errorf("save key: %s", err)
+	}
+	if err := osutil.Rename(certOut.Name(), certFile); err != nil {
+		return tls.Certificate{}, fmt.Errorf("save cert: %s", err)
+	}
+
+	return cert, nil
+}
+
+// encodeCertificate creates a self signed certificate for the given private
+// key and writes it and the key, PEM encoded, to the given writers.
+func encodeCertificate(certOut, keyOut io.Writer, opts CertificateOptions, sigAlgo x509.SignatureAlgorithm, priv crypto.Signer) (tls.Certificate, error) {
+	cert, err := newKeyPair(opts, sigAlgo, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	keyBlock, err := marshalPrivateKey(priv, opts)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	err = pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("save cert: %s", err)
+	}
+	err = pem.Encode(keyOut, keyBlock)
 	if err != nil {
 		return tls.Certificate{}, fmt.Errorf("save key: %s", err)
 	}
 
-	return tls.LoadX509KeyPair(certFile, keyFile)
+	return cert, nil
+}
+
+// newKeyPair creates a self signed certificate for the given private key
+// and returns it and the key as a tls.Certificate.
+func newKeyPair(opts CertificateOptions, sigAlgo x509.SignatureAlgorithm, priv crypto.Signer) (tls.Certificate, error) {
+	derBytes, err := createCertificate(opts, sigAlgo, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	leaf, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("parse cert: %s", err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{derBytes},
+		PrivateKey:  priv,
+		Leaf:        leaf,
+	}, nil
+}
+
+// withLeaf sets cert.Leaf, if it isn't set already, so that users of the
+// certificate don't need to parse it again.
+func withLeaf(cert tls.Certificate, err error) (tls.Certificate, error) {
+	if err != nil || cert.Leaf != nil {
+		return cert, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("parse cert: %s", err)
+	}
+	return cert, nil
+}
+
+// marshalPrivateKey returns the PEM block for the private key, in the
+// format requested by opts.
+func marshalPrivateKey(priv crypto.Signer, opts CertificateOptions) (*pem.Block, error) {
+	if !opts.PKCS8 && opts.Passphrase == "" {
+		switch priv := priv.(type) {
+		case *rsa.PrivateKey:
+			return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}, nil
+		case *ecdsa.PrivateKey:
+			bs, err := x509.MarshalECPrivateKey(priv)
+			if err != nil {
+				return nil, fmt.Errorf("marshal key: %s", err)
+			}
+			return &pem.Block{Type: "EC PRIVATE KEY", Bytes: bs}, nil
+		}
+	}
+
+	// Ed25519 keys can only be stored as PKCS#8.
+	bs, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("marshal key: %s", err)
+	}
+
+	if opts.Passphrase != "" {
+		block, err := encryptPKCS8(bs, opts.Passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("encrypt key: %s", err)
+		}
+		return block, nil
+	}
+
+	return &pem.Block{Type: "PRIVATE KEY", Bytes: bs}, nil
+}
+
+// createTemp creates a temporary file next to path. The file is given the
+// mode, if set, or is otherwise created with the default mode subject to the
+// umask.
+func createTemp(path string, mode, defaultMode os.FileMode) (*os.File, error) {
+	name := filepath.Join(filepath.Dir(path), osutil.TempPrefix+filepath.Base(path))
+	os.Remove(name)
+
+	fd, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, defaultMode)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(name, mode); err != nil {
+			fd.Close()
+			os.Remove(name)
+			return nil, err
+		}
+	}
+
+	return fd, nil
+}
+
+// syncClose flushes the file to disk and closes it.
+func syncClose(fd *os.File) error {
+	if err := fd.Sync(); err != nil {
+		return err
+	}
+	return fd.Close()
+}
+
+// createCertificate returns the DER encoding of a self signed certificate
+// for the given private key.
+func createCertificate(opts CertificateOptions, sigAlgo x509.SignatureAlgorithm, priv crypto.Signer) ([]byte, error) {
+	template, err := certificateTemplate(opts, sigAlgo)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.OmitKeyIdentifiers {
+		if template.SubjectKeyId, err = subjectKeyID(priv.Public()); err != nil {
+			return nil, err
+		}
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		return nil, fmt.Errorf("create cert: %s", err)
+	}
+
+	return derBytes, nil
+}
+
+// certificateTemplate returns the certificate template for the given
+// options.
+func certificateTemplate(opts CertificateOptions, sigAlgo x509.SignatureAlgorithm) (*x509.Certificate, error) {
+	now := time.Now()
+	notAfter := time.Date(2049, 12, 31, 23, 59, 59, 0, time.UTC)
+	if opts.Validity > 0 {
+		notAfter = now.Add(opts.Validity)
+	}
+	notBefore := now.Add(-DefaultClockSkew)
+	if opts.ClockSkew > 0 {
+		notBefore = now.Add(-opts.ClockSkew)
+	} else if opts.ClockSkew < 0 {
+		notBefore = now
+	}
+
+	keyUsage := x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+	if opts.KeyUsage != 0 {
+		keyUsage = opts.KeyUsage
+	}
+	extKeyUsage := []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	if opts.ExtKeyUsage != nil {
+		if len(opts.ExtKeyUsage) == 0 {
+			return nil, ErrNoKeyUsage
+		}
+		extKeyUsage = opts.ExtKeyUsage
+	}
+
+	serial, err := serialNumber(opts.PreviousSerials)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build new slices, so we don't modify the caller's.
+	var dnsNames []string
+	ipAddresses := append([]net.IP(nil), opts.IPAddresses...)
+	for _, name := range opts.DNSNames {
+		if ip := parseZonedIP(name); ip != nil {
+			ipAddresses = appendUniqueIP(ipAddresses, ip)
+		} else {
+			dnsNames = append(dnsNames, name)
+		}
+	}
+	if opts.InterfaceAddresses {
+		ips, err := localIPAddresses(opts.ExcludeLinkLocal)
+		if err != nil {
+			return nil, err
+		}
+		dnsNames = appendUniqueString(dnsNames, "localhost")
+		for _, ip := range ips {
+			ipAddresses = appendUniqueIP(ipAddresses, ip)
+		}
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:         opts.CommonName,
+			Organization:       opts.Organization,
+			OrganizationalUnit: opts.OrganizationalUnit,
+		},
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
+
+		DNSNames:    dnsNames,
+		IPAddresses: ipAddresses,
+
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           extKeyUsage,
+		BasicConstraintsValid: true,
+		SignatureAlgorithm:    sigAlgo,
+	}
+	if opts.MustStaple {
+		template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{
+			Id:    oidTLSFeature,
+			Value: mustStapleFeature,
+		})
+	}
+
+	return template, nil
+}
+
+// subjectKeyID returns the SHA-1 hash of the public key, as in the first
+// method for generating key identifiers in RFC 5280 section 4.2.1.2.
+func subjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("marshal public key: %s", err)
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(der, &spki); err != nil {
+		return nil, fmt.Errorf("parse public key: %s", err)
+	}
+	sum := sha1.Sum(spki.PublicKey.Bytes)
+	return sum[:], nil
+}
+
+// interfaceAddrs is net.InterfaceAddrs, unless replaced by tests.
+var interfaceAddrs = net.InterfaceAddrs
+
+// localIPAddresses returns 127.0.0.1 followed by the non-loopback interface
+// addresses.
+func localIPAddresses(excludeLinkLocal bool) ([]net.IP, error) {
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("interface addresses: %s", err)
+	}
+
+	ips := []net.IP{net.IPv4(127, 0, 0, 1)}
+	for _, addr := range addrs {
+		var ip net.IP
+		switch addr := addr.(type) {
+		case *net.IPNet:
+			ip = addr.IP
+		case *net.IPAddr:
+			// The zone of a link local address is dropped; it has no
+			// meaning outside of the host.
+			ip = addr.IP
+		default:
+			if ip = parseZonedIP(addr.String()); ip == nil {
+				continue
+			}
+		}
+		if ip.IsLoopback() {
+			continue
+		}
+		if excludeLinkLocal && (ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()) {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// parseZonedIP parses an IP address, ignoring any IPv6 zone, or returns nil
+// if s isn't an IP address.
+func parseZonedIP(s string) net.IP {
+	if i := strings.LastIndexByte(s, '%'); i >= 0 && strings.Contains(s[:i], ":") {
+		s = s[:i]
+	}
+	return net.ParseIP(s)
+}
+
+func appendUniqueString(ss []string, s string) []string {
+	for _, existing := range ss {
+		if existing == s {
+			return ss
+		}
+	}
+	return append(ss, s)
+}
+
+func appendUniqueIP(ips []net.IP, ip net.IP) []net.IP {
+	for _, existing := range ips {
+		if existing.Equal(ip) {
+			return ips
+		}
+	}
+	return append(ips, ip)
+}
+
+// serialReader is the source of serial numbers, unless replaced by tests.
+var serialReader io.Reader = rand.Reader
+
+// serialNumberAttempts is how many times serialNumber draws again when
+// hitting a serial to avoid. With 128 random bits that only happens with a
+// broken random source.
+const serialNumberAttempts = 10
+
+// serialNumber returns a random 128 bit certificate serial number, per the
+// recommendation in RFC 5280, that is none of the serials in avoid.
+func serialNumber(avoid []*big.Int) (*big.Int, error) {
+	max := new(big.Int).Lsh(big.NewInt(1), 128)
+	for i := 0; i < serialNumberAttempts; i++ {
+		serial, err := rand.Int(serialReader, max)
+		if err != nil {
+			return nil, fmt.Errorf("generate serial: %s", err)
+		}
+		if !containsSerial(avoid, serial) {
+			return serial, nil
+		}
+	}
+	return nil, errors.New("generate serial: no unused serial number found")
+}
+
+func containsSerial(serials []*big.Int, serial *big.Int) bool {
+	for _, s := range serials {
+		if s != nil && s.Cmp(serial) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultPeekTimeout is how long DowngradingListener waits for the first
+// bytes of a new connection by default.
+const DefaultPeekTimeout = 1 * time.Second
+
+// DefaultHandshakeTimeout is how long UpgradeToTLS and SecureDial wait for a
+// TLS handshake to complete.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// defaultBufferSize is the size of the bufio.Reader buffer used unless
+// DowngradingListener.BufferSize says otherwise; the same as the bufio
+// default.
+const defaultBufferSize = 4096
+
+// DefaultKeepAlive is the TCP keep-alive period DowngradingListener sets on
+// accepted connections by default.
+const DefaultKeepAlive = 30 * time.Second
+
+// Handshake runs the TLS handshake on conn, giving up after timeout. If the
+// handshake fails the connection is closed and the error returned. After a
+// successful handshake the deadline is cleared.
+func Handshake(conn *tls.Conn, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// UpgradeToTLS runs the server side TLS handshake on an already accepted
+// plaintext connection, as after a STARTTLS style command, giving up after
+// DefaultHandshakeTimeout. A UnionedConnection is read through rather than
+// unwrapped, so that data it already buffered, like a ClientHello sent right
+// after the command, is fed to the handshake. The caller must not have
+// buffered any data from conn itself.
+func UpgradeToTLS(conn net.Conn, cfg *tls.Config) (*tls.Conn, error) {
+	tc := tls.Server(conn, cfg)
+	if err := Handshake(tc, DefaultHandshakeTimeout); err != nil {
+		return nil, err
+	}
+	return tc, nil
 }
 
 type DowngradingListener struct {
 	net.Listener
 	TLSConfig *tls.Config
+
+	// PeekTimeout is how long to wait for the client to send the first
+	// bytes, to identify the connection type. The zero value means
+	// DefaultPeekTimeout.
+	PeekTimeout time.Duration
+
+	// PeekLength is the maximum number of bytes to wait for when
+	// identifying the connection type. The zero value means enough for the
+	// built in protocols; it needs to be larger only when Matchers look at
+	// longer prefixes. The bytes are not consumed.
+	PeekLength int
+
+	// BufferSize is the size of the buffer used to peek at each
+	// connection, which stays allocated until the data in it has been read
+	// or the connection is closed; after that reads go directly to the
+	// connection. The zero value means the bufio default of 4096 bytes. A
+	// smaller buffer saves memory with many connections that are slow to
+	// be read from. It's never smaller than the peek
+	// length, nor than the longest PROXY v1 header when ProxyProtocol is
+	// enabled.
+	BufferSize int
+
+	// Matchers are a shorthand for adding functions in front of the
+	// MatcherSet: they are tried in order, before MatcherSet or the built
+	// in detection, and the first one that returns something other than
+	// ProtocolUnknown decides. They don't change the peek length.
+	Matchers []MatchFunc
+
+	// MatcherSet replaces the built in detection, if set; start from
+	// DefaultMatchers to extend it. Unless PeekLength is set, the peek
+	// length is that of the MatcherSet.
+	MatcherSet MatcherSet
+
+	// ALPNConfigs maps ALPN protocol names to the TLS configuration to use
+	// for clients offering that protocol. Each configuration must be
+	// complete, as it replaces TLSConfig for the connection. Clients
+	// offering none of the protocols get TLSConfig. Call Handshake on the
+	// returned connection before looking at the negotiated protocol in its
+	// ConnectionState.
+	ALPNConfigs map[string]*tls.Config
+
+	// SNIConfigs maps lower case server names to the TLS configuration to
+	// use for clients requesting that name. Like ALPNConfigs each
+	// configuration must be complete. A matching server name takes
+	// precedence over ALPNConfigs, and clients requesting any other name
+	// get TLSConfig. Neither map, nor TLSConfig, may be changed after the
+	// first Accept when either is set.
+	SNIConfigs map[string]*tls.Config
+
+	// ProxyProtocol sets whether connections start with a PROXY protocol
+	// header. The header is consumed before identifying the connection,
+	// and its source address is returned by RemoteAddr. Connections with
+	// an invalid header, or without one when it's required, are closed.
+	// Headers are trusted as sent, so enable this only when clients can't
+	// reach the listener except through the proxy.
+	ProxyProtocol ProxyProtocolMode
+
+	// HandshakeTimeout, if set, starts the handshake of TLS connections in
+	// the background as they are accepted, and closes those that fail or
+	// don't finish within the timeout. Accept doesn't wait for it; reads
+	// and writes on the connection do. When zero the handshake is left to
+	// the first Read or Write, without a time limit.
+	HandshakeTimeout time.Duration
+
+	// OnHandshake, if set, is called with the client address and the time
+	// from receiving the first byte to completing the handshake, for every
+	// TLS connection that completes it. The handshake is then started in
+	// the background as with HandshakeTimeout, and OnHandshake is called
+	// from that goroutine.
+	OnHandshake func(addr net.Addr, d time.Duration)
+
+	// StrictTLS makes the listener reject connections that are not TLS,
+	// instead of returning them from Accept. Such clients get a TLS
+	// unexpected_message alert before the connection is closed, which
+	// tells a confused TLS client what went wrong. Connections where the
+	// client sends nothing within the peek timeout are still returned.
+	StrictTLS bool
+
+	// KeepAlive is the TCP keep-alive period for accepted TCP connections.
+	// The zero value means DefaultKeepAlive, and a negative value disables
+	// keep-alives.
+	KeepAlive time.Duration
+
+	// DisableNoDelay enables Nagle's algorithm on accepted TCP
+	// connections, trading latency for fewer small packets.
+	DisableNoDelay bool
+
+	// CountBytes makes the listener wrap accepted connections in a
+	// CountingConn, underneath the buffering used to identify them, so
+	// that the traffic on the wire is counted including the peeked bytes.
+	// Use ConnectionCounter to get at it.
+	CountBytes bool
+
+	// OnIdentifyError, if set, is called with the connection and the read
+	// error when the client sends nothing before the peek timeout, or the
+	// read fails. The connection is still returned from Accept afterwards,
+	// so the callback may close it to reject the client.
+	OnIdentifyError func(net.Conn, error)
+
+	// Logger, if set, is told about connections that fail identification
+	// or the TLS handshake in Accept, or that are dropped, so that it's
+	// possible to tell why a client was disconnected. Messages include the
+	// connection ID, for correlation with the caller's own logging.
+	Logger Logger
+
+	// ConnectionUUIDs gives each connection a random UUID, in addition to
+	// its ID, for correlation across listeners or processes.
+	ConnectionUUIDs bool
+
+	// lastID is the ID of the most recently accepted connection.
+	lastID atomic.Uint64
+
+	tlsCount    atomic.Int64
+	plainCount  atomic.Int64
+	failedCount atomic.Int64
+
+	// readers holds *bufio.Readers released by closed connections.
+	readers sync.Pool
+
+	// conns holds the accepted connections that are not yet closed.
+	connsMut sync.Mutex
+	conns    map[*UnionedConnection]struct{}
+
+	// serverCfg is the configuration for TLS connections when SNIConfigs
+	// or ALPNConfigs are set, built by serverConfig on first use.
+	serverCfgOnce sync.Once
+	serverCfg     *tls.Config
+}
+
+// TLSCount returns the number of accepted connections identified as TLS.
+func (l *DowngradingListener) TLSCount() int64 {
+	return l.tlsCount.Load()
+}
+
+// PlainCount returns the number of accepted connections identified as
+// something other than TLS.
+func (l *DowngradingListener) PlainCount() int64 {
+	return l.plainCount.Load()
+}
+
+// FailedCount returns the number of accepted connections that could not be
+// identified.
+func (l *DowngradingListener) FailedCount() int64 {
+	return l.failedCount.Load()
 }
 
 func (l *DowngradingListener) Accept() (net.Conn, error) {
-	conn, isTLS, err := l.AcceptNoWrapTLS()
+	conn, _, err := l.AcceptWithProtocol()
+	return conn, err
+}
+
+// Serve accepts connections and calls handle for each of them in a new
+// goroutine, until the listener is closed or ctx is cancelled. Cancelling
+// ctx closes the listener. Serve returns nil when stopped by ctx, otherwise
+// the error that stopped it.
+func (l *DowngradingListener) Serve(ctx context.Context, handle func(net.Conn)) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				// The error is the result of us closing the listener.
+				return nil
+			}
+			return err
+		}
+		go handle(conn)
+	}
+}
+
+// AcceptWithProtocol is like Accept, but also returns the protocol that was
+// identified for the connection. TLS connections are returned wrapped in a
+// TLS server.
+func (l *DowngradingListener) AcceptWithProtocol() (net.Conn, Protocol, error) {
+	conn, proto, err := l.acceptNoWrap()
 
 	// We failed to identify the socket type, pretend that everything is fine,
 	// and pass it to the underlying handler, and let them deal with it.
 	if err == ErrIdentificationFailed {
-		return conn, nil
+		return conn, ProtocolUnknown, nil
 	}
 
 	if err != nil {
-		return conn, err
+		return conn, proto, err
+	}
+
+	if proto != ProtocolTLS {
+		return conn, proto, nil
+	}
+
+	var tc *tls.Conn
+	if len(l.ALPNConfigs) == 0 && len(l.SNIConfigs) == 0 {
+		tc = tls.Server(conn, l.TLSConfig)
+	} else {
+		tc = tls.Server(conn, l.serverConfig())
 	}
 
-	if isTLS {
-		return tls.Server(conn, l.TLSConfig), nil
+	if l.HandshakeTimeout > 0 || l.OnHandshake != nil {
+		go l.handshake(tc, conn.(*UnionedConnection))
 	}
-	return conn, nil
+	return tc, proto, nil
+}
+
+// handshake runs the TLS handshake of an accepted connection in the
+// background, so that a slow client doesn't hold up Accept for the others.
+// Reads and writes on the connection wait for the handshake to complete. A
+// connection whose handshake fails, or doesn't finish within
+// HandshakeTimeout, is closed.
+func (l *DowngradingListener) handshake(tc *tls.Conn, uc *UnionedConnection) {
+	ctx := context.Background()
+	if l.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.HandshakeTimeout)
+		defer cancel()
+	}
+	if err := tc.HandshakeContext(ctx); err != nil {
+		loggerOrNop(l.Logger).Infof("TLS handshake with connection %d from %v failed: %v", uc.ID(), uc.RemoteAddr(), err)
+		tc.Close()
+		return
+	}
+	if l.OnHandshake != nil {
+		l.OnHandshake(tc.RemoteAddr(), time.Since(uc.firstByte))
+	}
+}
+
+// serverConfig returns a copy of TLSConfig that switches to the matching
+// configuration in SNIConfigs or ALPNConfigs based on the ClientHello. It's
+// built once and shared by all connections, as every copy of a tls.Config
+// gets its own automatic session ticket keys and sessions couldn't be
+// resumed otherwise.
+func (l *DowngradingListener) serverConfig() *tls.Config {
+	l.serverCfgOnce.Do(func() {
+		cfg := &tls.Config{}
+		if l.TLSConfig != nil {
+			cfg = l.TLSConfig.Clone()
+		}
+
+		// Each ALPN configuration accepts only its own protocol.
+		alpnCfgs := make(map[string]*tls.Config, len(l.ALPNConfigs))
+		for proto, alpnCfg := range l.ALPNConfigs {
+			alpnCfg = alpnCfg.Clone()
+			alpnCfg.NextProtos = []string{proto}
+			alpnCfgs[proto] = alpnCfg
+		}
+		sniCfgs := l.SNIConfigs
+
+		next := cfg.GetConfigForClient
+		cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if sniCfg, ok := sniCfgs[strings.ToLower(hello.ServerName)]; ok {
+				return sniCfg, nil
+			}
+			for _, proto := range hello.SupportedProtos {
+				if alpnCfg, ok := alpnCfgs[proto]; ok {
+					return alpnCfg, nil
+				}
+			}
+			if next != nil {
+				return next(hello)
+			}
+			return nil, nil
+		}
+		l.serverCfg = cfg
+	})
+	return l.serverCfg
 }
 
 func (l *DowngradingListener) AcceptNoWrapTLS() (net.Conn, bool, error) {
+	conn, proto, err := l.acceptNoWrap()
+	return conn, proto == ProtocolTLS, err
+}
+
+func (l *DowngradingListener) acceptNoWrap() (net.Conn, Protocol, error) {
+	for {
+		conn, proto, err := l.acceptOne()
+		if err == errDropped {
+			continue
+		}
+		return conn, proto, err
+	}
+}
+
+// errDropped is returned by acceptOne for a connection that was closed
+// because of an invalid or missing PROXY header, or for not being TLS with
+// StrictTLS set.
+var errDropped = fmt.Errorf("connection dropped")
+
+// unexpectedMessageAlert is a TLS 1.0 record holding a fatal
+// unexpected_message alert, understood by clients of any TLS version.
+var unexpectedMessageAlert = []byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x0a}
+
+func (l *DowngradingListener) acceptOne() (net.Conn, Protocol, error) {
 	conn, err := l.Listener.Accept()
 	if err != nil {
-		return nil, false, err
+		return nil, ProtocolUnknown, err
+	}
+	id := l.lastID.Add(1)
+	l.setTCPOptions(conn)
+	if l.CountBytes {
+		conn = NewCountingConn(conn)
 	}
 
-	br := bufio.NewReader(conn)
-	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-	bs, err := br.Peek(1)
-	conn.SetReadDeadline(time.Time{})
+	timeout := l.PeekTimeout
+	if timeout <= 0 {
+		timeout = DefaultPeekTimeout
+	}
+
+	br := l.newReader(conn)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	var remoteAddr net.Addr
+	if l.ProxyProtocol != ProxyProtocolOff {
+		remoteAddr, err = readProxyHeader(br, l.ProxyProtocol == ProxyProtocolRequired)
+		if err != nil {
+			loggerOrNop(l.Logger).Infof("Dropping connection %d from %v: PROXY header: %v", id, conn.RemoteAddr(), err)
+			conn.Close()
+			l.putReader(br)
+			l.failedCount.Add(1)
+			return nil, ProtocolUnknown, errDropped
+		}
+	}
+
+	_, err = br.Peek(1)
+	firstByte := time.Now()
 	if err != nil {
+		conn.SetReadDeadline(time.Time{})
+		l.failedCount.Add(1)
+		uc := l.newUnionedConnection(id, conn, br, ProtocolUnknown, remoteAddr, time.Time{})
+		conn = uc
+		loggerOrNop(l.Logger).Infof("Failed to identify connection %d from %v: %v", id, conn.RemoteAddr(), err)
+		if l.OnIdentifyError != nil {
+			l.OnIdentifyError(conn, err)
+		}
 		// We hit a read error here, but the Accept() call succeeded so we must not return an error.
-		// We return the connection as is with a special error which handles this
+		// We return the connection with a special error which handles this
 		// special case in Accept().
-		return conn, false, ErrIdentificationFailed
+		return conn, ProtocolUnknown, ErrIdentificationFailed
+	}
+
+	// Try to identify the protocol from what we got in the first read. If
+	// that's not enough, try again as more data arrives, up to the peek
+	// length; a client that sends less than that and then waits for us is
+	// identified after the timeout based on what we have.
+	matchers := l.matchers()
+	peekLength := l.peekLength()
+	if peekLength > br.Size() {
+		peekLength = br.Size()
+	}
+	bs, _ := br.Peek(br.Buffered())
+	proto, _ := matchers.Match(bs)
+	for proto == ProtocolUnknown && len(bs) < peekLength {
+		if _, err := br.Peek(len(bs) + 1); err != nil {
+			break
+		}
+		bs, _ = br.Peek(br.Buffered())
+		if len(bs) > peekLength {
+			bs = bs[:peekLength]
+		}
+		proto, _ = matchers.Match(bs)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if proto == ProtocolTLS {
+		l.tlsCount.Add(1)
+	} else {
+		l.plainCount.Add(1)
+	}
+
+	if l.StrictTLS && proto != ProtocolTLS {
+		addr := conn.RemoteAddr()
+		if remoteAddr != nil {
+			addr = remoteAddr
+		}
+		loggerOrNop(l.Logger).Infof("Dropping %v connection %d from %v: only TLS is allowed", proto, id, addr)
+		// Don't let a client that isn't reading hold up Accept.
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		conn.Write(unexpectedMessageAlert)
+		conn.Close()
+		l.putReader(br)
+		return nil, proto, errDropped
+	}
+
+	return l.newUnionedConnection(id, conn, br, proto, remoteAddr, firstByte), proto, nil
+}
+
+// newUnionedConnection returns a tracked UnionedConnection reading from br,
+// which buffers conn.
+func (l *DowngradingListener) newUnionedConnection(id uint64, conn net.Conn, br *bufio.Reader, proto Protocol, remoteAddr net.Addr, firstByte time.Time) *UnionedConnection {
+	uc := &UnionedConnection{Reader: br, Conn: conn, Protocol: proto, id: id, br: br, l: l, remoteAddr: remoteAddr, firstByte: firstByte}
+	if l.ConnectionUUIDs {
+		uc.uuid = newUUID()
+	}
+	l.track(uc)
+	return uc
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// setTCPOptions applies the keep-alive and no-delay settings, if conn is a
+// TCP connection, possibly wrapped by a listener like LimitListener. Errors
+// are ignored; they mean the connection is already broken, which the first
+// read or write reports.
+func (l *DowngradingListener) setTCPOptions(conn net.Conn) {
+	tc, ok := baseConn(conn).(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	if l.KeepAlive < 0 {
+		tc.SetKeepAlive(false)
+	} else {
+		period := l.KeepAlive
+		if period == 0 {
+			period = DefaultKeepAlive
+		}
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(period)
+	}
+	tc.SetNoDelay(!l.DisableNoDelay)
+}
+
+func (l *DowngradingListener) peekLength() int {
+	if l.PeekLength > 0 {
+		return l.PeekLength
+	}
+	return l.matchers().PeekLength()
+}
+
+// matchers returns the Matchers followed by the MatcherSet, or by the built
+// in matchers if there is none.
+func (l *DowngradingListener) matchers() MatcherSet {
+	set := l.MatcherSet
+	if set == nil {
+		set = defaultMatchers
+	}
+	if len(l.Matchers) == 0 {
+		return set
+	}
+	all := make(MatcherSet, 0, len(l.Matchers)+len(set))
+	for _, match := range l.Matchers {
+		all = append(all, match)
+	}
+	return append(all, set...)
+}
+
+// shutdownPollInterval is how often Shutdown checks for remaining open
+// connections.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown closes the listener and waits for the connections it accepted
+// to be closed. If ctx is done first the remaining connections are closed
+// and ctx.Err() returned.
+func (l *DowngradingListener) Shutdown(ctx context.Context) error {
+	// The listener may well be closed already, as by Serve.
+	l.Close()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		l.connsMut.Lock()
+		open := len(l.conns)
+		l.connsMut.Unlock()
+		if open == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			l.closeConnections()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *DowngradingListener) track(c *UnionedConnection) {
+	l.connsMut.Lock()
+	if l.conns == nil {
+		l.conns = make(map[*UnionedConnection]struct{})
+	}
+	l.conns[c] = struct{}{}
+	l.connsMut.Unlock()
+}
+
+func (l *DowngradingListener) untrack(c *UnionedConnection) {
+	l.connsMut.Lock()
+	delete(l.conns, c)
+	l.connsMut.Unlock()
+}
+
+func (l *DowngradingListener) closeConnections() {
+	l.connsMut.Lock()
+	conns := make([]*UnionedConnection, 0, len(l.conns))
+	for c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.connsMut.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func (l *DowngradingListener) newReader(conn net.Conn) *bufio.Reader {
+	size := l.bufferSize()
+	if br, ok := l.readers.Get().(*bufio.Reader); ok && br.Size() == size {
+		br.Reset(conn)
+		return br
+	}
+	return bufio.NewReaderSize(conn, size)
+}
+
+// bufferSize returns the reader buffer size, making room for the peek
+// length.
+func (l *DowngradingListener) bufferSize() int {
+	size := l.BufferSize
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	if peekLength := l.peekLength(); size < peekLength {
+		size = peekLength
 	}
+	if l.ProxyProtocol != ProxyProtocolOff && size < proxyV1MaxLength {
+		// The whole v1 header line must fit for ReadSlice to return it.
+		size = proxyV1MaxLength
+	}
+	return size
+}
 
-	return &UnionedConnection{br, conn}, bs[0] == 0x16, nil
+func (l *DowngradingListener) putReader(br *bufio.Reader) {
+	// Drop any buffered data and the reference to the connection, so that
+	// neither can leak into the next connection using the reader.
+	br.Reset(nil)
+	l.readers.Put(br)
 }
 
 type UnionedConnection struct {
 	io.Reader
 	net.Conn
+
+	// Protocol is the protocol identified from the first bytes read from
+	// the connection.
+	Protocol Protocol
+
+	id   uint64
+	uuid string
+
+	// mut protects br and Reader. br is returned to l once it's drained or
+	// the connection is closed, whichever comes first. It's never held
+	// while waiting for the network.
+	mut sync.Mutex
+	br  *bufio.Reader
+	l   *DowngradingListener
+
+	// remoteAddr is the client address given in a PROXY header, if any.
+	remoteAddr net.Addr
+
+	// firstByte is when the first byte of the connection was received.
+	firstByte time.Time
 }
 
+// Read reads from the buffered data first, and from the connection only
+// once the buffer is empty. Buffered data is returned regardless of the read
+// deadline; the deadline applies only when the connection itself is read,
+// so an expired deadline causes a timeout error once the buffer is drained.
 func (c *UnionedConnection) Read(b []byte) (n int, err error) {
-	return c.Reader.Read(b)
+	c.mut.Lock()
+	if c.br != nil {
+		if c.br.Buffered() > 0 {
+			// Served from memory, without touching the connection.
+			defer c.mut.Unlock()
+			return c.br.Read(b)
+		}
+		// Nothing more will be buffered; read the connection directly
+		// from now on.
+		c.releaseReader()
+	}
+	r := c.Reader
+	c.mut.Unlock()
+	return r.Read(b)
+}
+
+// releaseReader returns the buffered reader to the listener, after which
+// reads go directly to the connection. c.mut must be held.
+func (c *UnionedConnection) releaseReader() {
+	if c.l != nil {
+		c.l.putReader(c.br)
+	}
+	c.br = nil
+	c.Reader = c.Conn
+}
+
+// ID returns the connection ID, assigned in increasing order as the
+// listener accepts connections, starting at one.
+func (c *UnionedConnection) ID() uint64 {
+	return c.id
+}
+
+// UUID returns the random UUID of the connection, if the listener has
+// ConnectionUUIDs set, or the empty string.
+func (c *UnionedConnection) UUID() string {
+	return c.uuid
+}
+
+// Unwrap returns the connection as accepted from the underlying listener,
+// for access to features like SetLinger on a *net.TCPConn. Reading from it
+// directly skips any data still buffered. With CountBytes set on the
+// listener it's a *CountingConn, which in turn unwraps to the accepted
+// connection.
+func (c *UnionedConnection) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// Peeked returns a copy of the data that has been received but not yet
+// read, which after Accept includes the bytes used to identify the
+// connection. It doesn't wait for a concurrent Read to complete.
+func (c *UnionedConnection) Peeked() []byte {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if c.br == nil {
+		return nil
+	}
+	bs, _ := c.br.Peek(c.br.Buffered())
+	return append([]byte(nil), bs...)
+}
+
+// WriteTo writes the buffered data followed by the rest of the stream to w.
+// After the buffer is drained the copy goes directly from the connection,
+// allowing io.Copy to use the fast paths it would have for the connection
+// it wraps.
+func (c *UnionedConnection) WriteTo(w io.Writer) (int64, error) {
+	c.mut.Lock()
+	var written int64
+	if c.br != nil {
+		if c.br.Buffered() > 0 {
+			bs, _ := c.br.Peek(c.br.Buffered())
+			n, err := w.Write(bs)
+			c.br.Discard(n)
+			written += int64(n)
+			if err != nil {
+				c.mut.Unlock()
+				return written, err
+			}
+		}
+		c.releaseReader()
+	}
+	c.mut.Unlock()
+
+	n, err := io.Copy(w, c.Conn)
+	return written + n, err
+}
+
+// ReadFrom copies from r to the connection it wraps, using its ReadFrom
+// method if it has one.
+func (c *UnionedConnection) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.Conn, r)
+}
+
+// The embedded io.Reader only provides Read; the rest of the connection
+// methods are spelled out to make clear that they act on the connection
+// itself, unaffected by buffering.
+
+// LocalAddr returns the local address of the connection.
+func (c *UnionedConnection) LocalAddr() net.Addr {
+	return c.Conn.LocalAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the connection.
+func (c *UnionedConnection) SetDeadline(t time.Time) error {
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the connection. See Read for
+// how it interacts with buffered data.
+func (c *UnionedConnection) SetReadDeadline(t time.Time) error {
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the connection.
+func (c *UnionedConnection) SetWriteDeadline(t time.Time) error {
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// File returns a duplicate of the file descriptor of the connection
+// accepted from the underlying listener, if it has one, as a *net.TCPConn
+// does. As with SyscallConn, buffered data is not visible through it.
+func (c *UnionedConnection) File() (*os.File, error) {
+	base := baseConn(c.Conn)
+	fc, ok := base.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("file: not supported by %T", base)
+	}
+	return fc.File()
+}
+
+// CloseWrite shuts down the writing side of the connection, if the
+// connection accepted from the underlying listener supports it, as a
+// *net.TCPConn does.
+func (c *UnionedConnection) CloseWrite() error {
+	base := baseConn(c.Conn)
+	cw, ok := base.(interface{ CloseWrite() error })
+	if !ok {
+		return fmt.Errorf("close write: not supported by %T", base)
+	}
+	return cw.CloseWrite()
+}
+
+// SyscallConn returns a raw network connection for setting socket options
+// and the like, if the connection accepted from the underlying listener
+// supports it. Data already buffered is not visible through the raw
+// connection and is still returned first by Read; reading from the raw
+// connection directly skips it and breaks the stream.
+func (c *UnionedConnection) SyscallConn() (syscall.RawConn, error) {
+	base := baseConn(c.Conn)
+	sc, ok := base.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("syscall conn: not supported by %T", base)
+	}
+	return sc.SyscallConn()
+}
+
+// RemoteAddr returns the client address from the PROXY protocol header, if
+// there was one, otherwise the remote address of the connection.
+func (c *UnionedConnection) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// Close closes the connection. The buffered reader is returned to the
+// listener for reuse, and any further reads go directly to the closed
+// connection.
+func (c *UnionedConnection) Close() error {
+	err := c.Conn.Close()
+	if c.l == nil {
+		// Not accepted from a DowngradingListener.
+		return err
+	}
+	c.l.untrack(c)
+
+	c.mut.Lock()
+	if c.br != nil {
+		c.releaseReader()
+	}
+	c.mut.Unlock()
+
+	return err
 }
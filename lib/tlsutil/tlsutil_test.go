@@ -0,0 +1,1726 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewCertificateECDSA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if _, err := NewCertificateECDSA(certFile, keyFile, "syncthing", elliptic.P256()); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block, _ := pem.Decode(bs); block == nil || block.Type != "EC PRIVATE KEY" {
+		t.Errorf("key file doesn't hold an EC PRIVATE KEY block")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cert.PrivateKey.(*ecdsa.PrivateKey); !ok {
+		t.Errorf("got a %T key, expected ECDSA", cert.PrivateKey)
+	}
+	if err := testHandshake(cert); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewCertificateEd25519(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if _, err := NewCertificateEd25519(certFile, keyFile, "syncthing"); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := testHandshake(cert); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewCertificateInMemory(t *testing.T) {
+	cert, err := NewCertificateInMemory("syncthing", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cert.Leaf == nil {
+		t.Fatal("leaf should be set")
+	}
+	if cn := cert.Leaf.Subject.CommonName; cn != "syncthing" {
+		t.Errorf("incorrect common name %q", cn)
+	}
+
+	if err := testHandshake(cert); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testHandshake performs a TLS handshake over loopback with a server
+// presenting the given certificate.
+func testHandshake(cert tls.Certificate) error {
+	list, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		return err
+	}
+	defer list.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := list.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+		errs <- conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := tls.Dial("tcp", list.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return err
+	}
+	conn.Close()
+
+	return <-errs
+}
+
+func TestCertificateValidity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	before := time.Now()
+	cert, err := NewCertificateWithOptions(certFile, keyFile, CertificateOptions{
+		CommonName: "syncthing",
+		RSABits:    2048,
+		Validity:   90 * 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := before.Add(90 * 24 * time.Hour).Truncate(time.Second); leaf.NotAfter.Before(exp) || leaf.NotAfter.After(exp.Add(time.Minute)) {
+		t.Errorf("incorrect NotAfter %v, expected about %v", leaf.NotAfter, exp)
+	}
+}
+
+func TestCertificateSANs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert, err := NewCertificateWithOptions(certFile, keyFile, CertificateOptions{
+		CommonName:  "syncthing",
+		RSABits:     2048,
+		DNSNames:    []string{"localhost", "syncthing.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("2001:db8::1")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"localhost", "syncthing.example.com", "127.0.0.1", "2001:db8::1"} {
+		if err := leaf.VerifyHostname(name); err != nil {
+			t.Errorf("verify %s: %v", name, err)
+		}
+	}
+	if err := leaf.VerifyHostname("other.example.com"); err == nil {
+		t.Error("unexpected nil error for unlisted name")
+	}
+}
+
+func TestCertificateInterfaceAddresses(t *testing.T) {
+	oldInterfaceAddrs := interfaceAddrs
+	defer func() {
+		interfaceAddrs = oldInterfaceAddrs
+	}()
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+			&net.IPNet{IP: net.ParseIP("::1"), Mask: net.CIDRMask(128, 128)},
+			&net.IPNet{IP: net.ParseIP("192.168.1.10"), Mask: net.CIDRMask(24, 32)},
+			&net.IPNet{IP: net.ParseIP("2001:db8::10"), Mask: net.CIDRMask(64, 128)},
+			&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+			&net.IPNet{IP: net.ParseIP("169.254.1.1"), Mask: net.CIDRMask(16, 32)},
+		}, nil
+	}
+
+	cases := []struct {
+		excludeLinkLocal bool
+		expected         []string
+	}{
+		{false, []string{"127.0.0.1", "192.168.1.10", "2001:db8::10", "fe80::1", "169.254.1.1"}},
+		{true, []string{"127.0.0.1", "192.168.1.10", "2001:db8::10"}},
+	}
+
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range cases {
+		certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+		cert, err := NewCertificateWithOptions(certFile, keyFile, CertificateOptions{
+			CommonName:         "syncthing",
+			RSABits:            2048,
+			DNSNames:           []string{"syncthing.example.com"},
+			InterfaceAddresses: true,
+			ExcludeLinkLocal:   tc.excludeLinkLocal,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ips []string
+		for _, ip := range leaf.IPAddresses {
+			ips = append(ips, ip.String())
+		}
+		if strings.Join(ips, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("exclude link local %v: got IPs %v, expected %v", tc.excludeLinkLocal, ips, tc.expected)
+		}
+		if strings.Join(leaf.DNSNames, ",") != "syncthing.example.com,localhost" {
+			t.Errorf("got DNS names %v", leaf.DNSNames)
+		}
+	}
+}
+
+func TestCertificateZonedAddresses(t *testing.T) {
+	oldInterfaceAddrs := interfaceAddrs
+	defer func() {
+		interfaceAddrs = oldInterfaceAddrs
+	}()
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"},
+			&net.IPNet{IP: net.ParseIP("192.168.1.10"), Mask: net.CIDRMask(24, 32)},
+		}, nil
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := newKeyPair(CertificateOptions{
+		CommonName:         "syncthing",
+		DNSNames:           []string{"syncthing.example.com", "fe80::2%eth0", "10.0.0.1"},
+		InterfaceAddresses: true,
+	}, x509.ECDSAWithSHA256, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ips []string
+	for _, ip := range cert.Leaf.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	if exp := "fe80::2,10.0.0.1,127.0.0.1,fe80::1,192.168.1.10"; strings.Join(ips, ",") != exp {
+		t.Errorf("got IPs %v, expected %v", ips, exp)
+	}
+	if exp := "syncthing.example.com,localhost"; strings.Join(cert.Leaf.DNSNames, ",") != exp {
+		t.Errorf("got DNS names %v, expected %v", cert.Leaf.DNSNames, exp)
+	}
+}
+
+func TestCertificateOrganization(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	_, err = NewCertificateWithOptions(certFile, keyFile, CertificateOptions{
+		CommonName:         "syncthing",
+		Organization:       []string{"Example Corp"},
+		OrganizationalUnit: []string{"Fleet", "Storage"},
+		RSABits:            2048,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(bs)
+	if block == nil {
+		t.Fatal("no PEM block in certificate file")
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if leaf.Subject.CommonName != "syncthing" {
+		t.Errorf("incorrect common name %q", leaf.Subject.CommonName)
+	}
+	if !reflect.DeepEqual(leaf.Subject.Organization, []string{"Example Corp"}) {
+		t.Errorf("incorrect organization %v", leaf.Subject.Organization)
+	}
+	if !reflect.DeepEqual(leaf.Subject.OrganizationalUnit, []string{"Fleet", "Storage"}) {
+		t.Errorf("incorrect organizational unit %v", leaf.Subject.OrganizationalUnit)
+	}
+}
+
+func TestSerialNumberUnique(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		serial, err := serialNumber(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if serial.BitLen() > 128 {
+			t.Fatalf("serial %v is larger than 128 bits", serial)
+		}
+		if seen[serial.String()] {
+			t.Fatalf("duplicate serial %v", serial)
+		}
+		seen[serial.String()] = true
+	}
+}
+
+// stallRSAKeyGeneration makes RSA key generation block until the returned
+// function is called, so that tests of cancellation and fallback don't
+// leave a real key being generated in the background.
+func stallRSAKeyGeneration() func() {
+	old := rsaGenerateKey
+	release := make(chan struct{})
+	rsaGenerateKey = func(io.Reader, int) (*rsa.PrivateKey, error) {
+		<-release
+		return nil, errors.New("stalled")
+	}
+	return func() {
+		rsaGenerateKey = old
+		close(release)
+	}
+}
+
+func TestNewCertificateContextCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer stallRSAKeyGeneration()()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	t0 := time.Now()
+	_, err = NewCertificateContext(ctx, certFile, keyFile, CertificateOptions{
+		CommonName: "syncthing",
+		RSABits:    8192,
+	})
+	if err != context.Canceled {
+		t.Fatalf("unexpected error %v, expected %v", err, context.Canceled)
+	}
+	if d := time.Since(t0); d > time.Second {
+		t.Errorf("cancellation took %v", d)
+	}
+	if _, err := os.Stat(certFile); !os.IsNotExist(err) {
+		t.Error("certificate file should not exist")
+	}
+}
+
+func TestNewCertificateContextProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(d time.Duration) { progressInterval = d }(progressInterval)
+	progressInterval = 10 * time.Millisecond
+
+	var calls atomic.Int64
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	_, err = NewCertificateContext(context.Background(), certFile, keyFile, CertificateOptions{
+		CommonName: "syncthing",
+		RSABits:    4096,
+		Progress:   func() { calls.Add(1) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() == 0 {
+		t.Error("progress callback never called")
+	}
+
+	// No more calls once it's done.
+	n := calls.Load()
+	time.Sleep(50 * time.Millisecond)
+	if calls.Load() != n {
+		t.Error("progress callback called after generation finished")
+	}
+}
+
+func TestNewCertificateContextECDSAFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer stallRSAKeyGeneration()()
+
+	// The stalled RSA key generation takes far longer than the 100ms left
+	// before the fallback.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert, err := NewCertificateContext(ctx, certFile, keyFile, CertificateOptions{
+		CommonName:    "syncthing",
+		RSABits:       8192,
+		ECDSAFallback: 4900 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf == nil {
+		t.Fatal("Leaf not set")
+	}
+	if cert.Leaf.PublicKeyAlgorithm != x509.ECDSA {
+		t.Errorf("got a %v key, expected the ECDSA fallback", cert.Leaf.PublicKeyAlgorithm)
+	}
+	if _, ok := cert.PrivateKey.(*ecdsa.PrivateKey); !ok {
+		t.Errorf("private key is a %T, expected ECDSA", cert.PrivateKey)
+	}
+	if ctx.Err() != nil {
+		t.Error("fallback didn't finish before the deadline")
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewCertificateContextNoECDSAFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Plenty of time for the RSA key, so the fallback isn't used and the
+	// Leaf says so.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert, err := NewCertificateContext(ctx, certFile, keyFile, CertificateOptions{
+		CommonName:    "syncthing",
+		RSABits:       2048,
+		ECDSAFallback: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf == nil {
+		t.Fatal("Leaf not set")
+	}
+	if cert.Leaf.PublicKeyAlgorithm != x509.RSA {
+		t.Errorf("got a %v key, expected RSA", cert.Leaf.PublicKeyAlgorithm)
+	}
+	if _, ok := cert.PrivateKey.(*rsa.PrivateKey); !ok {
+		t.Errorf("private key is a %T, expected RSA", cert.PrivateKey)
+	}
+}
+
+func TestPrivateKeyFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		pkcs8     bool
+		blockType string
+	}{
+		{false, "RSA PRIVATE KEY"},
+		{true, "PRIVATE KEY"},
+	}
+
+	for _, tc := range cases {
+		certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+		_, err := NewCertificateWithOptions(certFile, keyFile, CertificateOptions{
+			CommonName: "syncthing",
+			RSABits:    2048,
+			PKCS8:      tc.pkcs8,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bs, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block, _ := pem.Decode(bs); block == nil || block.Type != tc.blockType {
+			t.Errorf("PKCS8=%v: expected a %q block", tc.pkcs8, tc.blockType)
+		}
+
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			t.Errorf("PKCS8=%v: %v", tc.pkcs8, err)
+		}
+	}
+}
+
+func TestEncryptedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert, err := NewCertificateEncrypted(certFile, keyFile, "syncthing", 2048, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		t.Error("unexpected nil error loading encrypted key without passphrase")
+	}
+
+	loaded, err := LoadKeyPairEncrypted(certFile, keyFile, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.Certificate[0], cert.Certificate[0]) {
+		t.Error("loaded certificate differs")
+	}
+	if err := testHandshake(loaded); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadKeyPairEncrypted(certFile, keyFile, "battery staple")
+	if err == nil || !strings.Contains(err.Error(), ErrIncorrectPassphrase.Error()) {
+		t.Errorf("unexpected error %v for wrong passphrase", err)
+	}
+}
+
+func TestEncryptedKeyIterations(t *testing.T) {
+	block, err := encryptPKCS8([]byte("not really a key"), "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrite the key with an iteration count that would take ages.
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(block.Bytes, &info); err != nil {
+		t.Fatal(err)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		t.Fatal(err)
+	}
+	var kdfParams pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams); err != nil {
+		t.Fatal(err)
+	}
+	kdfParams.IterationCount = 1 << 30
+	if params.KeyDerivationFunc.Parameters.FullBytes, err = asn1.Marshal(kdfParams); err != nil {
+		t.Fatal(err)
+	}
+	if info.Algorithm.Parameters.FullBytes, err = asn1.Marshal(params); err != nil {
+		t.Fatal(err)
+	}
+	if block.Bytes, err = asn1.Marshal(info); err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Now()
+	_, err = decryptPKCS8(block, "correct horse")
+	if err == nil || !strings.Contains(err.Error(), "iteration count") {
+		t.Errorf("unexpected error %v for a huge iteration count", err)
+	}
+	if d := time.Since(t0); d > time.Second {
+		t.Errorf("rejecting the key took %v", d)
+	}
+}
+
+func TestNewCertificateAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The key can't be written, so the certificate must not appear either.
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "missing", "key.pem")
+	if _, err := NewCertificate(certFile, keyFile, "syncthing", 2048); err == nil {
+		t.Fatal("unexpected nil error")
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		t.Errorf("unexpected file %s left behind", f.Name())
+	}
+}
+
+func TestCertificateFileModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not supported on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	_, err = NewCertificateWithOptions(certFile, keyFile, CertificateOptions{
+		CommonName:   "syncthing",
+		RSABits:      2048,
+		CertFileMode: 0640,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for file, mode := range map[string]os.FileMode{certFile: 0640, keyFile: 0600} {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != mode {
+			t.Errorf("%s has mode %v, expected %v", filepath.Base(file), perm, mode)
+		}
+	}
+}
+
+func TestNewCertificateTo(t *testing.T) {
+	var certBuf, keyBuf bytes.Buffer
+	cert, err := NewCertificateTo(&certBuf, &keyBuf, "syncthing", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := tls.X509KeyPair(certBuf.Bytes(), keyBuf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.Certificate[0], cert.Certificate[0]) {
+		t.Error("encoded certificate differs from returned certificate")
+	}
+	if err := testHandshake(cert); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadOrGenerateCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	// Missing; a new certificate is generated.
+
+	generated, err := LoadOrGenerateCertificate(certFile, keyFile, "syncthing", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(certFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// Present and valid; the same certificate is loaded.
+
+	loaded, err := LoadOrGenerateCertificate(certFile, keyFile, "syncthing", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.Certificate[0], generated.Certificate[0]) {
+		t.Error("loaded certificate differs from generated")
+	}
+
+	// Present but corrupt; an error is returned and nothing is overwritten.
+
+	if err := ioutil.WriteFile(certFile, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadOrGenerateCertificate(certFile, keyFile, "syncthing", 2048); err == nil {
+		t.Error("unexpected nil error for corrupt certificate")
+	}
+	bs, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "garbage" {
+		t.Error("corrupt certificate was overwritten")
+	}
+
+	// Only the certificate present; an error is returned and it's not
+	// overwritten.
+
+	if _, err := NewCertificateECDSA(certFile, keyFile, "syncthing", nil); err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadOrGenerateCertificate(certFile, keyFile, "syncthing", 2048); err == nil {
+		t.Error("unexpected nil error for missing key")
+	}
+	after, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after, before) {
+		t.Error("certificate without key was overwritten")
+	}
+	if _, err := os.Stat(keyFile); !os.IsNotExist(err) {
+		t.Error("key file should not have been created")
+	}
+
+	// A new key next to the old certificate, as when a regeneration is
+	// interrupted between the renames; a new certificate is generated.
+
+	if _, err := NewCertificateECDSA(filepath.Join(dir, "other-cert.pem"), keyFile, "syncthing", nil); err != nil {
+		t.Fatal(err)
+	}
+	logger := new(testLogger)
+	regenerated, err := LoadOrGenerateCertificateWithOptions(certFile, keyFile, LoadOptions{
+		Certificate: CertificateOptions{CommonName: "syncthing", RSABits: 2048},
+		Logger:      logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.Certificate[0], regenerated.Certificate[0]) {
+		t.Error("regenerated certificate was not saved")
+	}
+	if after, _ := ioutil.ReadFile(certFile); bytes.Equal(after, before) {
+		t.Error("mismatched certificate was not regenerated")
+	}
+	if len(logger.msgs) != 1 || !strings.Contains(logger.msgs[0], "does not match") {
+		t.Errorf("unexpected log messages %q", logger.msgs)
+	}
+}
+
+func TestLoadOrGenerateCertificateRegenerateInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	for src, dst := range map[string]string{"testdata/expired-cert.pem": certFile, "testdata/expired-key.pem": keyFile} {
+		bs, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(dst, bs, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expired, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the option the expired certificate is loaded as is.
+
+	opts := LoadOptions{Certificate: CertificateOptions{CommonName: "syncthing", RSABits: 2048}}
+	cert, err := LoadOrGenerateCertificateWithOptions(certFile, keyFile, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cert.Certificate[0], expired.Certificate[0]) {
+		t.Fatal("expired certificate should be loaded without RegenerateInvalid")
+	}
+
+	// With it, it's replaced and the change is logged.
+
+	logger := new(testLogger)
+	opts.RegenerateInvalid = true
+	opts.Logger = logger
+	cert, err = LoadOrGenerateCertificateWithOptions(certFile, keyFile, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(cert.Certificate[0], expired.Certificate[0]) {
+		t.Fatal("expired certificate was not regenerated")
+	}
+	if IsExpired(cert) {
+		t.Error("regenerated certificate should not be expired")
+	}
+	loaded, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.Certificate[0], cert.Certificate[0]) {
+		t.Error("regenerated certificate was not saved")
+	}
+	if len(logger.msgs) != 1 || !strings.HasPrefix(logger.msgs[0], "WARNING: ") || !strings.Contains(logger.msgs[0], "device ID") {
+		t.Errorf("unexpected log messages %q", logger.msgs)
+	}
+
+	// A valid certificate is kept.
+
+	again, err := LoadOrGenerateCertificateWithOptions(certFile, keyFile, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.Certificate[0], cert.Certificate[0]) {
+		t.Error("valid certificate was regenerated")
+	}
+}
+
+func TestCertificateKeyUsage(t *testing.T) {
+	cases := []struct {
+		requested []x509.ExtKeyUsage
+		expected  []x509.ExtKeyUsage
+	}{
+		{nil, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}},
+		{[]x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}},
+		{[]x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageOCSPSigning}, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageOCSPSigning}},
+	}
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range cases {
+		cert, err := newKeyPair(CertificateOptions{CommonName: "syncthing", ExtKeyUsage: tc.requested}, x509.SHA256WithRSA, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cert.Leaf.ExtKeyUsage, tc.expected) {
+			t.Errorf("incorrect ext key usage %v for %v", cert.Leaf.ExtKeyUsage, tc.requested)
+		}
+	}
+
+	_, err = newKeyPair(CertificateOptions{CommonName: "syncthing", ExtKeyUsage: []x509.ExtKeyUsage{}}, x509.SHA256WithRSA, priv)
+	if err != ErrNoKeyUsage {
+		t.Errorf("unexpected error %v for empty key usage", err)
+	}
+}
+
+func TestRenewCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	old, err := NewCertificateWithOptions(certFile, keyFile, CertificateOptions{
+		CommonName:   "syncthing",
+		RSABits:      2048,
+		Validity:     time.Hour,
+		CertFileMode: 0640,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldID, err := DeviceIDFromCertificate(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newID, err := RenewCertificate(certFile, keyFile, 90*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newID == oldID {
+		t.Error("device ID should change on renewal")
+	}
+
+	newKey, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(oldKey, newKey) {
+		t.Error("key file was modified")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := DeviceIDFromCertificate(cert); id != newID {
+		t.Errorf("returned device ID %s does not match certificate %s", newID, id)
+	}
+	if d, _ := TimeUntilExpiry(cert); d < 89*24*time.Hour {
+		t.Errorf("renewed certificate expires in %v", d)
+	}
+	if leaf, _ := leafCertificate(cert); leaf.Subject.CommonName != "syncthing" {
+		t.Errorf("incorrect common name %q after renewal", leaf.Subject.CommonName)
+	}
+
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(certFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0640 {
+			t.Errorf("renewed certificate has mode %v, expected 0640", perm)
+		}
+	}
+}
+
+func TestRenewCertificateCASigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, err := NewCA("ca", time.Hour, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := SignCertificate(ca.Cert, ca.Signer, "syncthing", nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, err := CertificatePEM(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := PrivateKeyPEM(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The certificate isn't replaced by a self signed one.
+	if _, err := RenewCertificate(certFile, keyFile, time.Hour); err == nil {
+		t.Error("unexpected nil error renewing a CA signed certificate")
+	}
+	bs, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, certPEM) {
+		t.Error("CA signed certificate was overwritten")
+	}
+}
+
+// repeatingReader returns each of a sequence of distinct values twice, so
+// that every other serial drawn collides with the previous one.
+type repeatingReader struct {
+	reads int
+}
+
+func (r *repeatingReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = byte(r.reads/2 + 1)
+	}
+	r.reads++
+	return len(b), nil
+}
+
+func TestRenewCertificateSerials(t *testing.T) {
+	oldSerialReader := serialReader
+	defer func() {
+		serialReader = oldSerialReader
+	}()
+	serialReader = new(repeatingReader)
+
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if _, err := NewCertificateECDSA(certFile, keyFile, "syncthing", elliptic.P256()); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		if i > 0 {
+			if _, err := RenewCertificate(certFile, keyFile, time.Hour); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := leafCertificate(cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[leaf.SerialNumber.String()] {
+			t.Fatalf("serial %v reused", leaf.SerialNumber)
+		}
+		seen[leaf.SerialNumber.String()] = true
+	}
+
+	// A random source giving nothing but serials to avoid is an error.
+	serialReader = bytes.NewReader(bytes.Repeat([]byte{1}, 16*serialNumberAttempts))
+	avoid := new(big.Int).SetBytes(bytes.Repeat([]byte{1}, 16))
+	if _, err := serialNumber([]*big.Int{avoid}); err == nil {
+		t.Error("unexpected nil error when every serial collides")
+	}
+}
+
+func TestCertificateClockSkew(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		skew     time.Duration
+		backdate time.Duration
+	}{
+		{0, DefaultClockSkew},
+		{time.Hour, time.Hour},
+		{-1, 0},
+	}
+
+	for _, tc := range cases {
+		now := time.Now()
+		cert, err := newKeyPair(CertificateOptions{CommonName: "syncthing", ClockSkew: tc.skew}, x509.SHA256WithRSA, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Certificate times have a one second resolution.
+		exp := now.Add(-tc.backdate).Truncate(time.Second)
+		if nb := cert.Leaf.NotBefore; nb.Before(exp.Add(-time.Second)) || nb.After(exp) {
+			t.Errorf("skew %v: NotBefore is %v, expected %v", tc.skew, nb, exp)
+		}
+	}
+}
+
+func TestDowngradingListenerPeekTimeout(t *testing.T) {
+	cases := []struct {
+		timeout time.Duration
+		isTLS   bool
+	}{
+		{50 * time.Millisecond, false},
+		{2 * time.Second, true},
+	}
+
+	for _, tc := range cases {
+		server, client := net.Pipe()
+		l := &DowngradingListener{
+			Listener:    newFakeListener(server),
+			PeekTimeout: tc.timeout,
+		}
+
+		// A slow client that sends the start of a TLS record after a delay.
+		go func() {
+			time.Sleep(250 * time.Millisecond)
+			client.Write([]byte{0x16, 0x03, 0x01})
+		}()
+
+		conn, isTLS, err := l.AcceptNoWrapTLS()
+		if tc.isTLS && err != nil {
+			t.Fatal(err)
+		}
+		if !tc.isTLS && err != ErrIdentificationFailed {
+			t.Errorf("timeout %v: unexpected error %v", tc.timeout, err)
+		}
+		if isTLS != tc.isTLS {
+			t.Errorf("timeout %v: isTLS %v, expected %v", tc.timeout, isTLS, tc.isTLS)
+		}
+		conn.Close()
+		client.Close()
+	}
+}
+
+func TestOnIdentifyError(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	var called net.Conn
+	var calledErr error
+	l := &DowngradingListener{
+		Listener:    newFakeListener(server),
+		PeekTimeout: 50 * time.Millisecond,
+		OnIdentifyError: func(conn net.Conn, err error) {
+			called = conn
+			calledErr = err
+			conn.Close()
+		},
+	}
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if called != conn {
+		t.Errorf("callback got %v, expected the accepted connection %v", called, conn)
+	}
+	if nerr, ok := calledErr.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("callback got error %v, expected a timeout", calledErr)
+	}
+
+	// The callback closed the connection.
+	if _, err := client.Write([]byte("late")); err == nil {
+		t.Error("connection should have been closed by the callback")
+	}
+}
+
+func TestDowngradingListenerLogger(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	logger := new(testLogger)
+	l := &DowngradingListener{
+		Listener:    newFakeListener(server),
+		PeekTimeout: 50 * time.Millisecond,
+		Logger:      logger,
+	}
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	logger.mut.Lock()
+	defer logger.mut.Unlock()
+	if len(logger.msgs) != 1 || !strings.HasPrefix(logger.msgs[0], "INFO: Failed to identify connection 1 from pipe: ") {
+		t.Errorf("unexpected log messages %q", logger.msgs)
+	}
+
+	// Without a Logger nothing is logged, and nothing breaks.
+	server, client = net.Pipe()
+	defer client.Close()
+	l = &DowngradingListener{Listener: newFakeListener(server), PeekTimeout: 50 * time.Millisecond}
+	if conn, err := l.Accept(); err != nil {
+		t.Fatal(err)
+	} else {
+		conn.Close()
+	}
+}
+
+func TestDowngradingListenerHandshakeTimeout(t *testing.T) {
+	stalledServer, stalledClient := net.Pipe()
+	defer stalledClient.Close()
+	plainServer, plainClient := net.Pipe()
+	defer plainClient.Close()
+
+	l := &DowngradingListener{
+		Listener:         newFakeListener(stalledServer, plainServer),
+		TLSConfig:        &tls.Config{Certificates: []tls.Certificate{TestCertificate()}},
+		HandshakeTimeout: 500 * time.Millisecond,
+	}
+
+	// A client that starts a TLS record and then stalls, followed by a
+	// plain text one.
+	go stalledClient.Write([]byte{0x16, 0x03, 0x01})
+	go plainClient.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+
+	// Neither waits for the stalled handshake.
+	t0 := time.Now()
+	stalled, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	plain, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if d := time.Since(t0); d >= l.HandshakeTimeout {
+		t.Errorf("Accept took %v, expected it not to wait for the handshake", d)
+	}
+	if _, ok := plain.(*tls.Conn); ok {
+		t.Error("plain text connection returned as TLS")
+	}
+
+	// The stalled connection is closed after the timeout.
+	stalledClient.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := stalledClient.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("unexpected read error %v, expected the connection to be closed", err)
+	}
+	if d := time.Since(t0); d < l.HandshakeTimeout {
+		t.Errorf("gave up after %v, before the handshake timeout", d)
+	}
+	if _, err := stalled.Read(make([]byte, 1)); err == nil {
+		t.Error("read succeeded on a connection without a handshake")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	list, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Close()
+
+	go func() {
+		conn, err := tls.Dial("tcp", list.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err == nil {
+			conn.Read(make([]byte, 1))
+			conn.Close()
+		}
+	}()
+
+	conn, err := list.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{TestCertificate()}})
+	defer tc.Close()
+	t0 := time.Now()
+	if err := Handshake(tc, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// The deadline is cleared after the handshake.
+	time.Sleep(time.Until(t0.Add(2200 * time.Millisecond)))
+	if _, err := tc.Write([]byte("ok")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandshakeStalled(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	// The client never sends its hello.
+	tc := tls.Server(server, &tls.Config{Certificates: []tls.Certificate{TestCertificate()}})
+	t0 := time.Now()
+	if err := Handshake(tc, 100*time.Millisecond); err == nil {
+		t.Fatal("handshake with a stalled client succeeded")
+	}
+	if d := time.Since(t0); d < 100*time.Millisecond {
+		t.Errorf("gave up after %v, before the timeout", d)
+	}
+}
+
+func TestUpgradeToTLS(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{TestCertificate()}}
+	// The command is identified as plain data after the peek timeout.
+	l := &DowngradingListener{Listener: raw, TLSConfig: cfg, PeekTimeout: 100 * time.Millisecond}
+	defer l.Close()
+
+	clientErr := make(chan error, 1)
+	go func() {
+		conn, err := net.Dial("tcp", raw.Addr().String())
+		if err != nil {
+			clientErr <- err
+			return
+		}
+		defer conn.Close()
+
+		// The ClientHello follows the command in the same write, so the
+		// server has it buffered from the peek when it upgrades.
+		tc := tls.Client(&prefixConn{Conn: conn, prefix: []byte("STARTTLS\n")}, &tls.Config{InsecureSkipVerify: true})
+		if _, err := tc.Write([]byte("ping")); err != nil {
+			clientErr <- err
+			return
+		}
+		_, err = io.ReadFull(tc, make([]byte, 4))
+		clientErr <- err
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 9)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "STARTTLS\n" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+	if len(conn.(*UnionedConnection).Peeked()) == 0 {
+		t.Fatal("expected the ClientHello to be buffered")
+	}
+
+	tc, err := UpgradeToTLS(conn, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(tc, buf[:4]); err != nil || string(buf[:4]) != "ping" {
+		t.Fatalf("read %q, %v", buf[:4], err)
+	}
+	if _, err := tc.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-clientErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// prefixConn sends prefix along with the first write.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Write(b []byte) (int, error) {
+	if c.prefix == nil {
+		return c.Conn.Write(b)
+	}
+	bs := append(c.prefix, b...)
+	c.prefix = nil
+	n, err := c.Conn.Write(bs)
+	if n -= len(bs) - len(b); n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+func TestCertificateLeaf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	generators := []struct {
+		name string
+		gen  func() (tls.Certificate, error)
+	}{
+		{"NewCertificate", func() (tls.Certificate, error) {
+			return NewCertificate(certFile, keyFile, "syncthing", 2048)
+		}},
+		{"LoadOrGenerateCertificate", func() (tls.Certificate, error) {
+			// Loads the files from the previous case.
+			return LoadOrGenerateCertificate(certFile, keyFile, "syncthing", 2048)
+		}},
+		{"NewCertificateECDSA", func() (tls.Certificate, error) {
+			return NewCertificateECDSA(certFile, keyFile, "syncthing", elliptic.P256())
+		}},
+		{"NewCertificateEd25519", func() (tls.Certificate, error) {
+			return NewCertificateEd25519(certFile, keyFile, "syncthing")
+		}},
+		{"NewCertificateInMemory", func() (tls.Certificate, error) {
+			return NewCertificateInMemory("syncthing", 2048)
+		}},
+		{"NewCertificateEncrypted", func() (tls.Certificate, error) {
+			return NewCertificateEncrypted(certFile, keyFile, "syncthing", 2048, "secret")
+		}},
+		{"LoadKeyPairEncrypted", func() (tls.Certificate, error) {
+			return LoadKeyPairEncrypted(certFile, keyFile, "secret")
+		}},
+	}
+
+	for _, g := range generators {
+		cert, err := g.gen()
+		if err != nil {
+			t.Fatalf("%s: %v", g.name, err)
+		}
+		if cert.Leaf == nil {
+			t.Errorf("%s: Leaf not set", g.name)
+			continue
+		}
+		if !bytes.Equal(cert.Leaf.Raw, cert.Certificate[0]) {
+			t.Errorf("%s: Leaf doesn't match the certificate", g.name)
+		}
+	}
+}
+
+func TestLoadKeyPairFromPEM(t *testing.T) {
+	var certPEM, keyPEM bytes.Buffer
+	cert, err := NewCertificateTo(&certPEM, &keyPEM, "syncthing", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadKeyPairFromPEM(certPEM.Bytes(), keyPEM.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Leaf == nil {
+		t.Fatal("Leaf not set")
+	}
+	if !bytes.Equal(loaded.Leaf.Raw, cert.Certificate[0]) {
+		t.Error("loaded certificate differs from generated")
+	}
+	if err := testHandshake(loaded); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := LoadKeyPairFromPEM(certPEM.Bytes(), []byte("garbage")); err == nil {
+		t.Error("unexpected nil error for invalid key")
+	}
+}
+
+func TestRSAKeySize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	for _, bits := range []int{0, 512, 1024, 2047} {
+		if _, err := generateRSAKey(context.Background(), bits, nil); err == nil {
+			t.Errorf("generateRSAKey: unexpected nil error for %d bits", bits)
+		}
+		if _, err := NewCertificateInMemory("syncthing", bits); err == nil {
+			t.Errorf("NewCertificateInMemory: unexpected nil error for %d bits", bits)
+		}
+		if _, err := NewCertificate(certFile, keyFile, "syncthing", bits); err == nil {
+			t.Errorf("NewCertificate: unexpected nil error for %d bits", bits)
+		}
+		if _, err := NewCA("syncthing", time.Hour, bits); err == nil {
+			t.Errorf("NewCA: unexpected nil error for %d bits", bits)
+		}
+	}
+	for _, file := range []string{certFile, keyFile} {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("%s was written for a rejected key size", file)
+		}
+	}
+
+	if _, err := NewCertificateInMemory("syncthing", 2048); err != nil {
+		t.Errorf("unexpected error for 2048 bits: %v", err)
+	}
+}
+
+func TestECDSACurves(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	cases := []struct {
+		curve   elliptic.Curve
+		name    string
+		sigAlgo x509.SignatureAlgorithm
+	}{
+		{nil, "P-256", x509.ECDSAWithSHA256},
+		{elliptic.P256(), "P-256", x509.ECDSAWithSHA256},
+		{elliptic.P384(), "P-384", x509.ECDSAWithSHA384},
+		{elliptic.P521(), "P-521", x509.ECDSAWithSHA512},
+	}
+
+	for _, tc := range cases {
+		cert, err := NewCertificateECDSA(certFile, keyFile, "syncthing", tc.curve)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name := cert.Leaf.PublicKey.(*ecdsa.PublicKey).Curve.Params().Name; name != tc.name {
+			t.Errorf("%s: key on curve %s", tc.name, name)
+		}
+		if cert.Leaf.SignatureAlgorithm != tc.sigAlgo {
+			t.Errorf("%s: signature algorithm %v, expected %v", tc.name, cert.Leaf.SignatureAlgorithm, tc.sigAlgo)
+		}
+		if err := testHandshake(cert); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+
+	if _, err := NewCertificateECDSA(certFile, keyFile, "syncthing", elliptic.P224()); err == nil {
+		t.Error("unexpected nil error for P-224")
+	}
+}
+
+// A fakeListener returns the given connections from Accept, then io.EOF.
+type fakeListener struct {
+	conns chan net.Conn
+}
+
+func newFakeListener(conns ...net.Conn) *fakeListener {
+	l := &fakeListener{conns: make(chan net.Conn, len(conns))}
+	for _, conn := range conns {
+		l.conns <- conn
+	}
+	close(l.conns)
+	return l
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	conn, ok := <-l.conns
+	if !ok {
+		return nil, io.EOF
+	}
+	return conn, nil
+}
+
+func (l *fakeListener) Close() error {
+	return nil
+}
+
+func (l *fakeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func TestDowngradingListenerServe(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &DowngradingListener{Listener: raw}
+
+	handled := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- l.Serve(ctx, func(conn net.Conn) {
+			conn.Close()
+			handled <- struct{}{}
+		})
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	defer conn.Close()
+
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not handled")
+	}
+
+	cancel()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Errorf("unexpected error %v from Serve", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after cancel")
+	}
+}
+
+func TestDowngradingListenerShutdown(t *testing.T) {
+	accept := func(l *DowngradingListener, client net.Conn) net.Conn {
+		go client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	t.Run("graceful", func(t *testing.T) {
+		server, client := net.Pipe()
+		defer client.Close()
+		l := &DowngradingListener{Listener: newFakeListener(server)}
+		conn := accept(l, client)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- l.Shutdown(context.Background())
+		}()
+
+		select {
+		case err := <-done:
+			t.Fatalf("Shutdown returned %v with a connection still open", err)
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		conn.Close()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Shutdown did not return after the connection was closed")
+		}
+	})
+
+	t.Run("forced", func(t *testing.T) {
+		server, client := net.Pipe()
+		defer client.Close()
+		l := &DowngradingListener{Listener: newFakeListener(server)}
+		accept(l, client)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if err := l.Shutdown(ctx); err != context.DeadlineExceeded {
+			t.Errorf("unexpected error %v, expected DeadlineExceeded", err)
+		}
+		if _, err := client.Write([]byte("late")); err == nil {
+			t.Error("connection should have been closed")
+		}
+	})
+}
+
+func TestDowngradingListenerStrictTLS(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	l := &DowngradingListener{
+		Listener:  newFakeListener(server),
+		StrictTLS: true,
+	}
+
+	received := make(chan []byte, 1)
+	go func() {
+		client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		bs, _ := ioutil.ReadAll(client)
+		received <- bs
+	}()
+
+	if _, err := l.Accept(); err != io.EOF {
+		t.Fatalf("unexpected error %v, expected the plain connection to be rejected", err)
+	}
+
+	// An unexpected_message alert, followed by the connection closing.
+	expected := []byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x0a}
+	select {
+	case bs := <-received:
+		if !bytes.Equal(bs, expected) {
+			t.Errorf("client received %x, expected %x", bs, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed")
+	}
+	if n := l.PlainCount(); n != 1 {
+		t.Errorf("plain count %d, expected 1", n)
+	}
+}
+
+func TestDowngradingListenerOnHandshake(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type handshake struct {
+		addr net.Addr
+		d    time.Duration
+	}
+	handshakes := make(chan handshake, 1)
+	l := &DowngradingListener{
+		Listener:  raw,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{TestCertificate()}},
+		OnHandshake: func(addr net.Addr, d time.Duration) {
+			handshakes <- handshake{addr, d}
+		},
+	}
+	defer l.Close()
+
+	localAddr := make(chan net.Addr, 1)
+	go func() {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			localAddr <- nil
+			return
+		}
+		localAddr <- conn.LocalAddr()
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case hs := <-handshakes:
+		if hs.d <= 0 || hs.d > 10*time.Second {
+			t.Errorf("implausible handshake duration %v", hs.d)
+		}
+		if addr := <-localAddr; addr == nil || hs.addr.String() != addr.String() {
+			t.Errorf("handshake reported for %v, expected the client at %v", hs.addr, addr)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("OnHandshake not called")
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrCertificateMismatch = errors.New("peer certificate does not match")
+	ErrNoClientAuthUsage   = errors.New("peer certificate is not valid for client authentication")
+)
+
+// VerifyPinnedCertificate returns nil if the leaf of rawCerts, as passed to
+// tls.Config.VerifyPeerCertificate, has the expected SHA-256 fingerprint.
+// The certificate is trusted based on the fingerprint alone, so the
+// configuration should set InsecureSkipVerify (or use
+// tls.RequireAnyClientCert on the server side) to skip the usual checks
+// against the system roots:
+//
+//	cfg.InsecureSkipVerify = true
+//	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+//		return tlsutil.VerifyPinnedCertificate(rawCerts, fingerprint)
+//	}
+func VerifyPinnedCertificate(rawCerts [][]byte, expected [32]byte) error {
+	if len(rawCerts) == 0 {
+		return ErrNoCertificate
+	}
+	if !FingerprintsEqual(sha256.Sum256(rawCerts[0]), expected) {
+		return ErrCertificateMismatch
+	}
+	return nil
+}
+
+// AllowDeviceIDs returns a function for tls.Config.VerifyPeerCertificate
+// that accepts only peers with one of the given device IDs, in any format
+// understood by ParseDeviceID; invalid IDs never match. Like
+// VerifyPinnedCertificate it doesn't depend on any other verification, so
+// use it with InsecureSkipVerify or tls.RequireAnyClientCert.
+func AllowDeviceIDs(ids ...string) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	allowed := make([]DeviceID, 0, len(ids))
+	for _, s := range ids {
+		if id, err := ParseDeviceID(s); err == nil {
+			allowed = append(allowed, id)
+		}
+	}
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return ErrNoCertificate
+		}
+		id := deviceIDFromRaw(rawCerts[0])
+
+		// Compare against all of them, so the time taken doesn't tell
+		// which one matched, if any.
+		found := false
+		for _, allowedID := range allowed {
+			if FingerprintsEqual(id, allowedID) {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("device ID %s is not allowed", id)
+		}
+		return nil
+	}
+}
+
+// PinDeviceIDVerifyConnection returns a function for
+// tls.Config.VerifyConnection that accepts only a peer with the expected
+// device ID. It's the same check as AllowDeviceIDs, for use where the rest
+// of the connection state is checked as well. An invalid expected ID
+// never matches.
+func PinDeviceIDVerifyConnection(expected string) func(tls.ConnectionState) error {
+	expectedID, parseErr := ParseDeviceID(expected)
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return ErrNoCertificate
+		}
+		if parseErr != nil {
+			return parseErr
+		}
+		id := deviceIDFromRaw(cs.PeerCertificates[0].Raw)
+		if !FingerprintsEqual(id, expectedID) {
+			return fmt.Errorf("device ID %s is not the expected %s", id, expectedID)
+		}
+		return nil
+	}
+}
+
+// RequireClientAuthUsage returns a function for
+// tls.Config.VerifyPeerCertificate that rejects peers whose leaf
+// certificate doesn't list client authentication (or any usage) in its
+// extended key usage. Certificates without the extension are rejected as
+// well, although the usual verification would allow them any usage. Use
+// it on the server side, combined with pinning where the certificates are
+// issued for specific purposes.
+func RequireClientAuthUsage() func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return ErrNoCertificate
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		if !hasExtKeyUsage(cert, x509.ExtKeyUsageClientAuth) && !hasExtKeyUsage(cert, x509.ExtKeyUsageAny) {
+			return ErrNoClientAuthUsage
+		}
+		return nil
+	}
+}
+
+// DialConfig returns a client configuration that presents myCert and only
+// accepts a server with the expected device ID.
+func DialConfig(myCert tls.Certificate, expectedDeviceID string) *tls.Config {
+	cfg := SecureDefaultTLSConfig(myCert)
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyPeerCertificate = AllowDeviceIDs(expectedDeviceID)
+	return cfg
+}
+
+func hasExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+)
+
+func TestVerifyPinnedCertificate(t *testing.T) {
+	pinned, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewCertificateInMemory("syncthing", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp, err := CertificateFingerprint(pinned)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyPinnedCertificate(pinned.Certificate, fp); err != nil {
+		t.Errorf("pinned certificate rejected: %v", err)
+	}
+	if err := VerifyPinnedCertificate(other.Certificate, fp); err != ErrCertificateMismatch {
+		t.Errorf("other certificate: unexpected error %v", err)
+	}
+	if err := VerifyPinnedCertificate(nil, fp); err != ErrNoCertificate {
+		t.Errorf("no certificate: unexpected error %v", err)
+	}
+
+	// In a handshake, with a self signed certificate that would fail normal
+	// verification.
+	clientCfg := &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return VerifyPinnedCertificate(rawCerts, fp)
+		},
+	}
+	if _, err := handshakeConfigs(&tls.Config{Certificates: []tls.Certificate{pinned}}, clientCfg); err != nil {
+		t.Errorf("handshake with pinned certificate failed: %v", err)
+	}
+	if _, err := handshakeConfigs(&tls.Config{Certificates: []tls.Certificate{other}}, clientCfg); err == nil {
+		t.Error("handshake with other certificate should fail")
+	}
+}
+
+func TestAllowDeviceIDs(t *testing.T) {
+	allowed, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewCertificateInMemory("syncthing", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := TestCertificate()
+
+	// The allowed ID in a different format than we generate.
+	const allowedID = "7refmdrmziectrjdc37xtmcmp2d6elylxk2xlrqfqmwliqnmljbhntag"
+	serverCfg := &tls.Config{
+		Certificates:          []tls.Certificate{server},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: AllowDeviceIDs("AAAAAAA-BBBBBBB", allowedID),
+	}
+
+	clientCfg := &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{allowed}}
+	if _, err := handshakeConfigs(serverCfg, clientCfg); err != nil {
+		t.Errorf("allowed device rejected: %v", err)
+	}
+
+	clientCfg = &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{other}}
+	if _, err := handshakeConfigs(serverCfg, clientCfg); err == nil {
+		t.Error("other device should be rejected")
+	}
+
+	clientCfg = &tls.Config{InsecureSkipVerify: true}
+	if _, err := handshakeConfigs(serverCfg, clientCfg); err == nil {
+		t.Error("client without certificate should be rejected")
+	}
+}
+
+func TestDialConfig(t *testing.T) {
+	server, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := TestCertificate()
+	serverCfg := &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientAuth:   tls.RequireAnyClientCert,
+	}
+
+	const serverID = "7REFMDR-MZIECTR-JDC37XT-MCMP2D6-ELYLXK2-XLRQFQM-WLIQNML-JBHNTAG"
+	state, err := handshakeConfigs(serverCfg, DialConfig(client, serverID))
+	if err != nil {
+		t.Fatalf("handshake with expected device failed: %v", err)
+	}
+	if len(state.PeerCertificates) == 0 {
+		t.Error("no peer certificates")
+	}
+
+	const otherID = "MFZWI3D-BONSGYC-YLTMRWG-C43ENR5-QXGZDMM-FZWI3DP-BONSGYY-LTMRWAD"
+	if _, err := handshakeConfigs(serverCfg, DialConfig(client, otherID)); err == nil {
+		t.Error("handshake with unexpected device should fail")
+	}
+}
+
+func TestPinDeviceIDVerifyConnection(t *testing.T) {
+	server, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCfg := &tls.Config{Certificates: []tls.Certificate{server}}
+
+	cases := []struct {
+		expected string
+		ok       bool
+	}{
+		{fixtureDeviceID, true},
+		{"MFZWI3D-BONSGYC-YLTMRWG-C43ENR5-QXGZDMM-FZWI3DP-BONSGYY-LTMRWAD", false},
+		{"not a device ID", false},
+	}
+	for _, tc := range cases {
+		clientCfg := &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyConnection:   PinDeviceIDVerifyConnection(tc.expected),
+		}
+		_, err := handshakeConfigs(serverCfg, clientCfg)
+		if tc.ok && err != nil {
+			t.Errorf("%q: unexpected error %v", tc.expected, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%q: handshake should have failed", tc.expected)
+		}
+	}
+}
+
+func TestRequireClientAuthUsage(t *testing.T) {
+	newCert := func(usage ...x509.ExtKeyUsage) tls.Certificate {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := newKeyPair(CertificateOptions{CommonName: "syncthing", ExtKeyUsage: usage}, x509.ECDSAWithSHA256, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	serverCfg := &tls.Config{
+		Certificates:          []tls.Certificate{TestCertificate()},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: RequireClientAuthUsage(),
+	}
+
+	dualUse := newCert(x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth)
+	clientCfg := &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{dualUse}}
+	if _, err := handshakeConfigs(serverCfg, clientCfg); err != nil {
+		t.Errorf("dual use certificate rejected: %v", err)
+	}
+
+	serverOnly := newCert(x509.ExtKeyUsageServerAuth)
+	clientCfg = &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{serverOnly}}
+	if _, err := handshakeConfigs(serverCfg, clientCfg); err == nil {
+		t.Error("server auth only certificate should be rejected")
+	}
+	if err := RequireClientAuthUsage()(serverOnly.Certificate, nil); err != ErrNoClientAuthUsage {
+		t.Errorf("server auth only certificate: unexpected error %v", err)
+	}
+
+	clientCfg = &tls.Config{InsecureSkipVerify: true}
+	if _, err := handshakeConfigs(serverCfg, clientCfg); err == nil {
+		t.Error("client without certificate should be rejected")
+	}
+}